@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"brightpod/pkg/client"
+	"brightpod/pkg/config"
+	"brightpod/pkg/mqtt"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	redacted = "******"
+)
+
+var (
+	// secretFlags are never printed or logged with their value.
+	secretFlags = map[string]bool{
+		"mqtt-password": true,
+		"api-token":     true,
+	}
+
+	// configSections are the config file keys that have no flag of their own.
+	configSections = map[string]bool{
+		"acl":           true,
+		"bridge":        true,
+		"delivery":      true,
+		"listeners":     true,
+		"devices":       true,
+		"homeassistant": true,
+		"limits":        true,
+		"topics":        true,
+	}
+)
+
+func newConfigCommand(configArgs *ConfigArguments) *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspects the configuration",
+	}
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:          "validate",
+		Short:        "Validates the configuration from flags, environment, .env and config file",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := loadConfig(cmd, configArgs)
+			if errs, ok := err.(config.Errors); ok {
+				for _, err := range errs {
+					fmt.Fprintf(cmd.ErrOrStderr(), "- %s\n", err)
+				}
+				return fmt.Errorf("found %d problems in the configuration", len(errs))
+			} else if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid")
+			return nil
+		},
+	})
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:          "show",
+		Short:        "Prints the effective configuration with secrets redacted",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfig(cmd, configArgs); err != nil {
+				return err
+			}
+
+			out, err := yaml.Marshal(effectiveConfig(cmd, configArgs))
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), string(out))
+			return nil
+		},
+	})
+
+	return configCmd
+}
+
+// loadConfig parses and validates the parts of the configuration that the
+// flags cannot check on their own, and reports every problem found as
+// config.Errors.
+func loadConfig(cmd *cobra.Command, configArgs *ConfigArguments) error {
+	errs := config.Errors{}
+
+	for _, key := range configArgs.viper.AllKeys() {
+		section := strings.SplitN(key, ".", 2)[0]
+		if cmd.Flags().Lookup(section) == nil && !configSections[section] {
+			errs = append(errs, fmt.Errorf("unknown configuration key: %s", key))
+		}
+	}
+
+	if configArgs.mqttServer {
+		// brightpod attaches to the built-in server in-process, the password
+		// only lets other clients connect as the same user.
+		configArgs.mqttUsername = controllerUsername(configArgs)
+	} else if configArgs.mqttHost == "" {
+		errs = append(errs, fmt.Errorf("mqtt-host is required"))
+	}
+	if configArgs.offlineTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("offline-timeout must be positive, recieved: %s", configArgs.offlineTimeout))
+	}
+	if configArgs.mqttLockout.MaxFailures < 0 {
+		errs = append(errs, fmt.Errorf("mqtt-lockout-failures cannot be negative, recieved: %d", configArgs.mqttLockout.MaxFailures))
+	}
+	if configArgs.mqttLockout.MaxFailures > 0 && (configArgs.mqttLockout.Window <= 0 || configArgs.mqttLockout.Duration <= 0) {
+		errs = append(errs, fmt.Errorf("mqtt-lockout-window and mqtt-lockout-duration must be positive"))
+	}
+	if configArgs.mqttClient.connectAttempts < 0 {
+		errs = append(errs, fmt.Errorf("mqtt-connect-attempts cannot be negative, recieved: %d", configArgs.mqttClient.connectAttempts))
+	}
+	if configArgs.mqttClient.maxRetryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("mqtt-retry-max-interval must be positive, recieved: %s", configArgs.mqttClient.maxRetryInterval))
+	}
+	if !configArgs.mqttClient.cleanSession && configArgs.mqttClient.clientID == "" {
+		errs = append(errs, fmt.Errorf("mqtt-client-id is required without mqtt-clean-session"))
+	}
+	if configArgs.commandTTL <= 0 {
+		errs = append(errs, fmt.Errorf("command-ttl must be positive, recieved: %s", configArgs.commandTTL))
+	}
+
+	configArgs.serverUsers = map[string]string{}
+	for i, credential := range configArgs.mqttServerUsers {
+		username, password, err := mqtt.ParseUser(credential)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mqtt-server-users entry %d: %w", i+1, err))
+			continue
+		}
+		if _, ok := configArgs.serverUsers[username]; ok || username == configArgs.mqttUsername {
+			errs = append(errs, fmt.Errorf("mqtt-server-users: user %s is declared more than once", username))
+			continue
+		}
+		configArgs.serverUsers[username] = password
+	}
+	if configArgs.mqttUsersFile != "" {
+		// A missing file has no users yet, they can be added at runtime.
+		fileUsers, err := mqtt.ReadUsersFile(configArgs.mqttUsersFile)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("mqtt-users-file: %w", err))
+		}
+		for username, hash := range fileUsers {
+			if _, ok := configArgs.serverUsers[username]; ok || username == configArgs.mqttUsername {
+				errs = append(errs, fmt.Errorf("mqtt-users-file: user %s is declared more than once", username))
+				continue
+			}
+			configArgs.serverUsers[username] = hash
+		}
+	}
+
+	listeners, err := config.LoadListeners(configArgs.viper)
+	if listenerErrs, ok := err.(config.Errors); ok {
+		errs = append(errs, listenerErrs...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	if len(listeners) > 0 && configArgs.mqttTLSListen != "" {
+		errs = append(errs, fmt.Errorf("mqtt-server-tls-listen cannot be combined with listeners, declare a tls listener instead"))
+	}
+	if len(listeners) == 0 && err == nil {
+		listeners = mqtt.DefaultListeners()
+		if configArgs.mqttTLSListen != "" {
+			tlsOptions := configArgs.mqttServerTLS
+			listener := mqtt.ListenerOptions{
+				Type:    mqtt.ListenerTLS,
+				Address: configArgs.mqttTLSListen,
+				TLS:     &tlsOptions,
+				Auth:    mqtt.AuthPassword,
+			}
+			if configArgs.mqttTLSCerts {
+				listener.Auth = mqtt.AuthCertificate
+			}
+			if err := listener.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mqtt-server-tls: %w", err))
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	configArgs.listeners = listeners
+
+	mqttTLS, err := client.TLSConfig(configArgs.mqttCAFile, configArgs.mqttCertFile, configArgs.mqttKeyFile)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("mqtt tls: %w", err))
+	}
+	configArgs.mqttTLS = mqttTLS
+
+	acl, err := config.LoadACL(configArgs.viper)
+	if aclErrs, ok := err.(config.Errors); ok {
+		errs = append(errs, aclErrs...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	configArgs.acl = acl
+
+	limits, err := config.LoadLimits(configArgs.viper)
+	if limitsErrs, ok := err.(config.Errors); ok {
+		errs = append(errs, limitsErrs...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	configArgs.limits = limits
+
+	bridge, err := config.LoadBridge(configArgs.viper)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if bridge != nil {
+		bridgeTLS, err := client.TLSConfig(bridge.CAFile, bridge.CertFile, bridge.KeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bridge tls: %w", err))
+		}
+		configArgs.bridgeTLS = bridgeTLS
+	}
+	configArgs.bridge = bridge
+
+	layout, err := config.LoadTopics(configArgs.viper)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	configArgs.topics = layout
+
+	delivery, err := config.LoadDelivery(configArgs.viper)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	configArgs.delivery = delivery
+
+	inventory, err := config.LoadInventory(configArgs.viper)
+	if inventoryErrs, ok := err.(config.Errors); ok {
+		errs = append(errs, inventoryErrs...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	configArgs.inventory = inventory
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// effectiveConfig returns the merged configuration, keyed the same way as the
+// config file, with every secret redacted.
+func effectiveConfig(cmd *cobra.Command, configArgs *ConfigArguments) map[string]interface{} {
+	settings := map[string]interface{}{}
+
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" {
+			return
+		}
+
+		var value interface{}
+		switch f.Value.Type() {
+		case "bool":
+			value = cast.ToBool(f.Value.String())
+		case "int":
+			value = cast.ToInt(f.Value.String())
+		default:
+			value = f.Value.String()
+		}
+		if sliceValue, ok := f.Value.(pflag.SliceValue); ok {
+			value = sliceValue.GetSlice()
+		}
+		settings[f.Name] = redact(f.Name, value)
+	})
+
+	if configArgs.inventory != nil {
+		devices := []config.Device{}
+		for _, device := range configArgs.inventory.Devices {
+			devices = append(devices, device)
+		}
+		sort.Slice(devices, func(i, j int) bool {
+			return devices[i].ID < devices[j].ID
+		})
+		settings["devices"] = devices
+		settings["homeassistant"] = configArgs.inventory.HomeAssistant
+	}
+	settings["topics"] = configArgs.topics
+	settings["delivery"] = configArgs.delivery
+	settings["listeners"] = configArgs.listeners
+	if configArgs.bridge != nil {
+		bridge := *configArgs.bridge
+		if bridge.Password != "" {
+			bridge.Password = redacted
+		}
+		settings["bridge"] = bridge
+	}
+
+	acl := []config.ACLEntry{}
+	for username, rule := range configArgs.acl {
+		acl = append(acl, config.ACLEntry{User: username, Rule: rule})
+	}
+	sort.Slice(acl, func(i, j int) bool {
+		return acl[i].User < acl[j].User
+	})
+	settings["acl"] = acl
+
+	limits := []config.LimitsEntry{}
+	for username, userLimits := range configArgs.limits {
+		limits = append(limits, config.LimitsEntry{User: username, Limits: userLimits})
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].User < limits[j].User
+	})
+	settings["limits"] = limits
+
+	return settings
+}
+
+func redact(name string, value interface{}) interface{} {
+	if name == "mqtt-server-users" {
+		users := []string{}
+		for _, credential := range value.([]string) {
+			username, _, err := mqtt.ParseUser(credential)
+			if err != nil {
+				users = append(users, redacted)
+				continue
+			}
+			users = append(users, fmt.Sprintf("%s:%s", username, redacted))
+		}
+		return users
+	}
+
+	if secretFlags[name] && value != "" {
+		return redacted
+	}
+	return value
+}
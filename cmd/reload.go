@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"brightpod/cmd/util"
+	"brightpod/pkg/admin"
+	"brightpod/pkg/client"
+	"brightpod/pkg/config"
+	"brightpod/pkg/mqtt"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+// reloadLock serializes the reloads, which change the arguments of the running
+// program in place.
+var reloadLock sync.Mutex
+
+// watchReloads reloads the configuration on SIGHUP and, when --watch-config is
+// set, whenever the config file or the users file changes. The server is nil
+// when the built-in mqtt server is not running, and so are the users managed
+// at runtime. Reloads change configArgs in place, as the flags point into it,
+// so the caller must be done reading it.
+func watchReloads(ctx context.Context, cmd *cobra.Command, configArgs *ConfigArguments, server *mqtt.Server, users *admin.Users, controller *client.Controller) {
+	triggers := make(chan string, 1)
+	trigger := func(reason string) {
+		select {
+		case triggers <- reason:
+		default:
+			// A reload is already pending and will pick up this change too.
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				trigger("SIGHUP")
+			case <-ctx.Done():
+				signal.Stop(sigs)
+				return
+			}
+		}
+	}()
+
+	if configArgs.watchConfig && configArgs.viper.ConfigFileUsed() != "" {
+		configArgs.viper.OnConfigChange(func(e fsnotify.Event) {
+			trigger("a change of " + e.Name)
+		})
+		configArgs.viper.WatchConfig()
+	}
+	if configArgs.watchConfig && server != nil && configArgs.mqttUsersFile != "" {
+		if err := watchFile(ctx, configArgs.mqttUsersFile, trigger); err != nil {
+			log.Printf("Could not watch the users file %s: %s", configArgs.mqttUsersFile, err)
+		}
+	}
+
+	go func() {
+		for reason := range triggers {
+			reloadConfig(cmd, configArgs, server, users, controller, reason)
+		}
+	}()
+}
+
+// watchFile calls onChange whenever the file is written or replaced. The
+// directory is watched rather than the file, as the users file is replaced
+// atomically when it is saved.
+func watchFile(ctx context.Context, path string, onChange func(reason string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	path = filepath.Clean(path)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					onChange("a change of " + event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching %s: %s", path, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadConfig reads the configuration again and applies the broker users and
+// the device inventory. Other settings only take effect after a restart. An
+// invalid configuration is rejected as a whole.
+func reloadConfig(cmd *cobra.Command, configArgs *ConfigArguments, server *mqtt.Server, users *admin.Users, controller *client.Controller, reason string) {
+	log.Printf("Reloading configuration after %s", reason)
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous := *configArgs
+	v, err := util.ReloadConfig(cmd)
+	if err == nil {
+		if username := controllerUsername(configArgs); username != previous.mqttUsername {
+			// The controller is connected and known to the server under
+			// its name, renaming it would lock it out.
+			log.Printf("The mqtt-username %q only takes effect after a restart, keeping %q", username, previous.mqttUsername)
+			configArgs.mqttUsername = previous.mqttUsername
+		}
+		configArgs.viper = v
+		err = loadConfig(cmd, configArgs)
+	}
+	if err != nil {
+		// The flags point into configArgs, so this restores them as well.
+		*configArgs = previous
+		log.Printf("Could not reload configuration, keeping the previous one: %s", err)
+		return
+	}
+
+	if server != nil {
+		server.SetUsers(brokerUsers(configArgs))
+		server.SetACL(configArgs.acl, brokerDefaultRule(configArgs))
+		server.SetLimits(configArgs.limits, brokerDefaultLimits(configArgs))
+		users.SetStatic(staticUsers(configArgs))
+	}
+	controller.UpdateInventory(configArgs.inventory, configArgs.devices)
+	log.Printf("Configuration reloaded")
+}
+
+// controllerUsername returns the user brightpod connects as, the default one
+// on the built-in mqtt server when none is set.
+func controllerUsername(configArgs *ConfigArguments) string {
+	if configArgs.mqttServer && configArgs.mqttUsername == "" {
+		return mqtt.DefaultController
+	}
+	return configArgs.mqttUsername
+}
+
+// brokerUsers returns every user of the built-in mqtt server, including the
+// user brightpod connects with when it has a password.
+func brokerUsers(configArgs *ConfigArguments) map[string]string {
+	users := map[string]string{}
+	if configArgs.mqttPassword != "" {
+		users[configArgs.mqttUsername] = configArgs.mqttPassword
+	}
+	for username, password := range configArgs.serverUsers {
+		users[username] = password
+	}
+	return users
+}
+
+// staticUsers returns the users of the built-in mqtt server that do not come
+// from the users file and cannot be managed at runtime.
+func staticUsers(configArgs *ConfigArguments) []string {
+	usernames := []string{configArgs.mqttUsername}
+	for _, credential := range configArgs.mqttServerUsers {
+		if username, _, err := mqtt.ParseUser(credential); err == nil {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// brokerDefaultRule returns the topic rule of users without an acl entry. The
+// user brightpod connects with has full access, every other user is treated
+// as a blower that may only send its keepalives and read its status.
+func brokerDefaultRule(configArgs *ConfigArguments) func(username string) mqtt.Rule {
+	controller := configArgs.mqttUsername
+	layout := configArgs.topics
+	return func(username string) mqtt.Rule {
+		if username == controller {
+			return mqtt.FullAccess()
+		}
+		return mqtt.Rule{
+			Read:  []string{layout.StatusTopic(username)},
+			Write: []string{layout.KeepAliveTopic(username)},
+		}
+	}
+}
+
+// brokerDefaultLimits returns the limits of users without a limits entry,
+// the ones of the "*" entry. The user brightpod connects with is never
+// limited.
+func brokerDefaultLimits(configArgs *ConfigArguments) func(username string) mqtt.Limits {
+	controller := configArgs.mqttUsername
+	limits := configArgs.limits[config.AnyUser]
+	return func(username string) mqtt.Limits {
+		if username == controller {
+			return mqtt.Limits{}
+		}
+		return limits
+	}
+}
@@ -2,25 +2,72 @@ package cmd
 
 import (
 	"brightpod/cmd/util"
+	"brightpod/pkg/admin"
+	"brightpod/pkg/api"
 	"brightpod/pkg/client"
+	"brightpod/pkg/config"
 	"brightpod/pkg/mqtt"
+	"brightpod/pkg/topics"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
-	"strings"
+	"net/http"
+	"os"
+	"time"
 
+	"github.com/logrusorgru/aurora"
+	"github.com/mochi-co/hanami"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 type ConfigArguments struct {
 	mqttServer      bool
 	mqttServerUsers []string
+	mqttUsersFile   string
+	mqttPairedFile  string
+	mqttServerStore string
+	mqttServerTLS   mqtt.TLSOptions
+	mqttTLSListen   string
+	mqttTLSCerts    bool
+	mqttLockout     mqtt.LockoutOptions
+	mqttAuditLog    string
 	mqttUsername    string
 	mqttPassword    string
 	mqttHost        string
+	mqttCAFile      string
+	mqttCertFile    string
+	mqttKeyFile     string
+	mqttClient      mqttClientOptions
+	offlineTimeout  time.Duration
+	commandTTL      time.Duration
+	devices         []string
+	apiListen       string
+	apiToken        string
+	configFile      string
+	credentialsFile string
+	watchConfig     bool
+	viper           *viper.Viper
+	serverUsers     map[string]string
+	inventory       *config.Inventory
+	listeners       []mqtt.ListenerOptions
+	mqttTLS         *tls.Config
+	topics          topics.Layout
+	delivery        topics.DeliveryOptions
+	acl             map[string]mqtt.Rule
+	limits          map[string]mqtt.Limits
+	bridge          *mqtt.BridgeOptions
+	bridgeTLS       *tls.Config
 }
 
-const (
-	brokerPort = 1883
-)
+// mqttClientOptions configures the session of brightpod with the mqtt server.
+type mqttClientOptions struct {
+	clientID         string
+	cleanSession     bool
+	connectAttempts  int
+	maxRetryInterval time.Duration
+}
 
 func NewRootCommand() *cobra.Command {
 
@@ -30,6 +77,11 @@ func NewRootCommand() *cobra.Command {
 		mqttUsername:    "",
 		mqttPassword:    "",
 		mqttHost:        "",
+		offlineTimeout:  2 * time.Minute,
+		commandTTL:      10 * time.Minute,
+		devices:         []string{},
+		apiListen:       "",
+		apiToken:        "",
 	}
 
 	// Define our command
@@ -39,46 +91,245 @@ func NewRootCommand() *cobra.Command {
 		Long:  `Connects or runs a mqtt server that allows a connected smart fan to be controlled via HomeAssistant`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			// You can bind cobra and viper in a few locations, but PersistencePreRunE on the root command works well
-			return util.InitializeConfig(cmd)
+			var err error
+			configArgs.viper, err = util.InitializeConfig(cmd)
+			return err
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			log.Printf("%+v", configArgs)
-			runProgram(&configArgs)
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := loadConfig(cmd, &configArgs); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			log.Printf("%+v", effectiveConfig(cmd, &configArgs))
+			return runProgram(cmd.Context(), cmd, &configArgs)
 		},
 	}
+	rootCmd.AddCommand(newConfigCommand(&configArgs))
+	rootCmd.AddCommand(newUsersCommand(&configArgs))
+
+	rootCmd.PersistentFlags().StringVar(&configArgs.configFile,
+		"config", "", "Path to the config file, defaults to brightpod.yaml in the working directory or /etc/brightpod.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.credentialsFile,
+		"credentials-file", "", "Path to a file holding secrets such as mqtt-password, merged on top of the config file.")
+	rootCmd.PersistentFlags().BoolVar(&configArgs.watchConfig,
+		"watch-config", false, "Reloads the users and the device inventory when the config file or the users file changes, as on SIGHUP.")
 
 	// mqtt server
 	rootCmd.PersistentFlags().BoolVar(&configArgs.mqttServer,
 		"mqtt-run-server", false, "Runs the built-in mqtt server.")
 	rootCmd.PersistentFlags().StringSliceVar(&configArgs.mqttServerUsers,
 		"mqtt-server-users", []string{}, "Users that can access the built-in mqtt server.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttUsersFile,
+		"mqtt-users-file", "", "htpasswd style file with bcrypt hashed users of the built-in mqtt server, see the users command.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttPairedFile,
+		"mqtt-paired-devices-file", "", "File the IDs of devices paired at runtime are kept in, so they stay declared across restarts.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttServerStore,
+		"mqtt-server-store", "", "File the built-in mqtt server keeps retained messages, sessions and inflight messages in across restarts. Disabled when empty.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttTLSListen,
+		"mqtt-server-tls-listen", "", "Address of a TLS listener of the built-in mqtt server, e.g. :8883. Ignored when the config file declares listeners.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttServerTLS.CertFile,
+		"mqtt-server-tls-cert", "", "PEM certificate of the TLS listener.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttServerTLS.KeyFile,
+		"mqtt-server-tls-key", "", "PEM private key of the TLS listener.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttServerTLS.CAFile,
+		"mqtt-server-tls-ca", "", "PEM CA certificates that client certificates are verified with.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttServerTLS.MinVersion,
+		"mqtt-server-tls-min-version", "1.2", "Lowest TLS version accepted by the TLS listener: 1.0, 1.1, 1.2 or 1.3.")
+	rootCmd.PersistentFlags().BoolVar(&configArgs.mqttTLSCerts,
+		"mqtt-server-tls-client-certs", false, "Requires client certificates on the TLS listener and uses their common name as the user.")
+	rootCmd.PersistentFlags().IntVar(&configArgs.mqttLockout.MaxFailures,
+		"mqtt-lockout-failures", 5, "Failed logins after which a user at a client address, or the address, is locked out of the built-in mqtt server. Disabled when 0.")
+	rootCmd.PersistentFlags().DurationVar(&configArgs.mqttLockout.Window,
+		"mqtt-lockout-window", 5*time.Minute, "Time within which failed logins count towards a lockout.")
+	rootCmd.PersistentFlags().DurationVar(&configArgs.mqttLockout.Duration,
+		"mqtt-lockout-duration", 15*time.Minute, "Time a user at a client address, or the address, stays locked out.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttAuditLog,
+		"mqtt-audit-log", "", "File every login and topic access decision of the built-in mqtt server is appended to as JSON lines.")
 
 	// app config
 	rootCmd.PersistentFlags().StringVar(&configArgs.mqttUsername,
-		"mqtt-username", "", "Defines the username to connect to the mqtt instance")
+		"mqtt-username", "", "Defines the username to connect to the mqtt instance, and the user brightpod acts as on the built-in mqtt server (default \"brightpod\")")
 	rootCmd.PersistentFlags().StringVar(&configArgs.mqttPassword,
 		"mqtt-password", "", "Defines the password to connect to the mqtt instance")
 	rootCmd.PersistentFlags().StringVar(&configArgs.mqttHost,
-		"mqtt-host", "", "Defines the password to connect to the mqtt instance")
+		"mqtt-host", "", "Defines the mqtt instance to connect to, brightpod attaches to the built-in mqtt server in-process instead")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttCAFile,
+		"mqtt-ca-file", "", "PEM CA certificates the mqtt instance is verified with, for ssl:// hosts. Defaults to the system roots.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttCertFile,
+		"mqtt-cert-file", "", "PEM client certificate to connect to the mqtt instance with.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttKeyFile,
+		"mqtt-key-file", "", "PEM private key of the client certificate.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.mqttClient.clientID,
+		"mqtt-client-id", "brightpod", "Client ID brightpod connects to the mqtt instance with.")
+	rootCmd.PersistentFlags().BoolVar(&configArgs.mqttClient.cleanSession,
+		"mqtt-clean-session", true, "Starts a new session on every connection. Otherwise the mqtt instance keeps the subscriptions and queued messages of brightpod while it is away.")
+	rootCmd.PersistentFlags().IntVar(&configArgs.mqttClient.connectAttempts,
+		"mqtt-connect-attempts", 0, "Number of times connecting to the mqtt instance is tried on startup, 0 tries until stopped.")
+	rootCmd.PersistentFlags().DurationVar(&configArgs.mqttClient.maxRetryInterval,
+		"mqtt-retry-max-interval", time.Minute, "Longest wait between attempts to connect to the mqtt instance, which doubles from a second.")
+
+	// offline command queue
+	rootCmd.PersistentFlags().DurationVar(&configArgs.offlineTimeout,
+		"offline-timeout", 2*time.Minute, "Time without a keepalive after which a blower is considered offline.")
+	rootCmd.PersistentFlags().DurationVar(&configArgs.commandTTL,
+		"command-ttl", 10*time.Minute, "Time a command for an offline blower is kept in the queue.")
+	rootCmd.PersistentFlags().StringSliceVar(&configArgs.devices,
+		"devices", []string{}, "Blower IDs that accept queued commands before they have connected.")
+
+	// api
+	rootCmd.PersistentFlags().StringVar(&configArgs.apiListen,
+		"api-listen", "", "Address the HTTP API listens on, e.g. :8080. The API is disabled when empty.")
+	rootCmd.PersistentFlags().StringVar(&configArgs.apiToken,
+		"api-token", "", "Bearer token required by the HTTP API.")
 
 	return rootCmd
 }
 
-func runProgram(config *ConfigArguments) {
+// runProgram runs brightpod until the context is done. It then shuts down in
+// the reverse order of starting: the client first, so that it can still mark
+// the blowers offline, and the broker last.
+func runProgram(ctx context.Context, cmd *cobra.Command, config *ConfigArguments) error {
+	defer log.Println(aurora.BgGreen("Finished"))
+
+	var server *mqtt.Server
+	var users *admin.Users
+	var onConnect []func(client *hanami.Client) error
 	if config.mqttServer {
-		log.Printf("Starting MQTT service on port: %d", brokerPort)
-		server := mqtt.New(brokerPort)
-		server.Start()
-
-		server.ConfigureUser(config.mqttUsername, config.mqttPassword)
-		for _, userPassword := range config.mqttServerUsers {
-			userPwdSplit := strings.SplitN(userPassword, ":", 2)
-			if len(userPwdSplit) != 2 {
-				log.Fatalf("Cannot parse user password credential: %s", userPassword)
+		server = mqtt.New(config.listeners)
+		users = admin.NewUsers(server, config.mqttUsersFile)
+		users.SetStatic(staticUsers(config))
+		onConnect = append(onConnect, users.Subscribe)
+	}
+
+	clientOptions := client.Options{
+		Username:         config.mqttUsername,
+		Password:         config.mqttPassword,
+		Server:           config.mqttHost,
+		TLSConfig:        config.mqttTLS,
+		OfflineTimeout:   config.offlineTimeout,
+		CommandTTL:       config.commandTTL,
+		Devices:          config.devices,
+		Inventory:        config.inventory,
+		Topics:           config.topics,
+		Delivery:         config.delivery,
+		OnConnect:        onConnect,
+		ClientID:         config.mqttClient.clientID,
+		CleanSession:     config.mqttClient.cleanSession,
+		ConnectAttempts:  config.mqttClient.connectAttempts,
+		MaxRetryInterval: config.mqttClient.maxRetryInterval,
+	}
+	if server != nil {
+		// Attach to the built-in server without credentials or a network hop.
+		clientOptions.Server = mqtt.InProcessAddress
+		clientOptions.Password = ""
+		clientOptions.TLSConfig = nil
+		clientOptions.OpenConnection = server.OpenConnection
+	}
+	controller := client.New(clientOptions)
+
+	if server != nil {
+		log.Printf("Starting MQTT service with %d listeners", len(config.listeners))
+		if config.mqttServerStore != "" {
+			server.SetStore(mqtt.NewFileStore(config.mqttServerStore, time.Second))
+		}
+		if config.mqttPairedFile != "" {
+			paired, err := admin.ReadPairedDevices(config.mqttPairedFile)
+			if err != nil {
+				return fmt.Errorf("could not read the paired devices: %w", err)
+			}
+			for _, id := range paired {
+				controller.RegisterDevice(id)
 			}
-			server.ConfigureUser(userPwdSplit[0], userPwdSplit[1])
+			users.SetPairedFile(config.mqttPairedFile)
 		}
+		users.OnPaired(controller.RegisterDevice)
+		server.SetUnknownUserHandler(users.Pair)
+		server.SetConnectionHandler(controller.HandleConnectionEvent)
+		server.SetLockout(config.mqttLockout)
+		if config.mqttAuditLog != "" {
+			file, err := os.OpenFile(config.mqttAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return fmt.Errorf("could not open the audit log: %w", err)
+			}
+			defer file.Close()
+			server.SetAuditHandler(mqtt.NewAuditLog(file).Write)
+		}
+
+		server.SetController(config.mqttUsername)
+		server.SetUsers(brokerUsers(config))
+		server.SetACL(config.acl, brokerDefaultRule(config))
+		server.SetLimits(config.limits, brokerDefaultLimits(config))
+		if err := server.Start(); err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+	if config.bridge != nil {
+		log.Printf("Bridging to the MQTT broker at: %s", config.bridge.Address)
+		local := mqtt.BridgeEndpoint{
+			Address:   config.mqttHost,
+			Username:  config.mqttUsername,
+			Password:  config.mqttPassword,
+			TLSConfig: config.mqttTLS,
+		}
+		if server != nil {
+			local = mqtt.BridgeEndpoint{
+				Address:        mqtt.InProcessAddress,
+				OpenConnection: server.OpenConnection,
+			}
+		}
+		bridge := mqtt.NewBridge(*config.bridge, local, mqtt.BridgeEndpoint{
+			Address:   config.bridge.Address,
+			Username:  config.bridge.Username,
+			Password:  config.bridge.Password,
+			ClientID:  config.bridge.ClientID,
+			TLSConfig: config.bridgeTLS,
+		})
+		bridge.Start()
+		defer bridge.Close()
+	}
+
+	if config.apiListen != "" {
+		log.Printf("Starting API on: %s", config.apiListen)
+		apiServer := api.New(config.apiListen, config.apiToken)
+		apiServer.HandleFunc("/api/queue", func(w http.ResponseWriter, r *http.Request) {
+			api.WriteJSON(w, http.StatusOK, controller.PendingCommands())
+		})
+		apiServer.HandleFunc("/api/blowers", func(w http.ResponseWriter, r *http.Request) {
+			api.WriteJSON(w, http.StatusOK, controller.States())
+		})
+		apiServer.HandleFunc("/api/client", func(w http.ResponseWriter, r *http.Request) {
+			api.WriteJSON(w, http.StatusOK, controller.Connection())
+		})
+		if server != nil {
+			apiServer.HandleFunc("/api/connections", func(w http.ResponseWriter, r *http.Request) {
+				api.WriteJSON(w, http.StatusOK, controller.ConnectionHistory())
+			})
+			apiServer.HandleFunc("/api/dropped", func(w http.ResponseWriter, r *http.Request) {
+				api.WriteJSON(w, http.StatusOK, server.Dropped())
+			})
+			apiServer.HandleFunc("/api/lockouts", func(w http.ResponseWriter, r *http.Request) {
+				api.WriteJSON(w, http.StatusOK, server.Lockouts())
+			})
+		}
+		if users != nil {
+			if config.apiToken != "" {
+				users.RegisterAPI(apiServer)
+			} else {
+				log.Printf("User management is not available on the API without --api-token")
+			}
+		}
+		apiServer.Start()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := apiServer.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Could not stop the API: %s", err)
+			}
+		}()
 	}
 
-	client.Start(config.mqttUsername, config.mqttPassword, config.mqttHost)
+	// Reloads start once nothing else reads the configuration.
+	watchReloads(ctx, cmd, config, server, users, controller)
+	return controller.Run(ctx)
 }
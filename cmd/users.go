@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"brightpod/pkg/mqtt"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func newUsersCommand(configArgs *ConfigArguments) *cobra.Command {
+	usersCmd := &cobra.Command{
+		Use:   "users",
+		Short: "Manages the users file of the built-in mqtt server",
+		Long: `Manages the users file set with --mqtt-users-file. A running server picks up the
+changes on SIGHUP, or right away with --watch-config.`,
+	}
+
+	var password string
+	addCmd := &cobra.Command{
+		Use:          "add <username>",
+		Short:        "Adds a user or changes its password",
+		Long:         "Adds a user or changes its password. The password is prompted for, or read from stdin when it is not a terminal.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			username := args[0]
+			if strings.Contains(username, ":") {
+				return fmt.Errorf("username cannot contain ':'")
+			}
+			controller := configArgs.mqttUsername
+			if controller == "" {
+				controller = mqtt.DefaultController
+			}
+			if username == controller {
+				return fmt.Errorf("user %s is the user brightpod connects with, set with --mqtt-password", username)
+			}
+
+			users, err := readUsersFile(configArgs, true)
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				password, err = readPassword(cmd)
+				if err != nil {
+					return err
+				}
+			}
+			if password == "" {
+				return fmt.Errorf("password cannot be empty")
+			}
+
+			_, exists := users[username]
+			users[username], err = mqtt.HashPassword(password)
+			if err != nil {
+				return err
+			}
+			if err := mqtt.WriteUsersFile(configArgs.mqttUsersFile, users); err != nil {
+				return err
+			}
+			if exists {
+				fmt.Fprintf(cmd.OutOrStdout(), "Changed the password of user %s\n", username)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "Added user %s\n", username)
+			}
+			return nil
+		},
+	}
+	addCmd.Flags().StringVar(&password, "password", "", "Password of the user, prompted for when empty.")
+	usersCmd.AddCommand(addCmd)
+
+	usersCmd.AddCommand(&cobra.Command{
+		Use:          "remove <username>",
+		Short:        "Removes a user",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			username := args[0]
+			users, err := readUsersFile(configArgs, false)
+			if err != nil {
+				return err
+			}
+			if _, ok := users[username]; !ok {
+				return fmt.Errorf("no user with name: %s", username)
+			}
+			delete(users, username)
+			if err := mqtt.WriteUsersFile(configArgs.mqttUsersFile, users); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed user %s\n", username)
+			return nil
+		},
+	})
+
+	usersCmd.AddCommand(&cobra.Command{
+		Use:          "list",
+		Short:        "Lists the users",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			users, err := readUsersFile(configArgs, true)
+			if err != nil {
+				return err
+			}
+			usernames := make([]string, 0, len(users))
+			for username := range users {
+				usernames = append(usernames, username)
+			}
+			sort.Strings(usernames)
+			for _, username := range usernames {
+				fmt.Fprintln(cmd.OutOrStdout(), username)
+			}
+			return nil
+		},
+	})
+
+	return usersCmd
+}
+
+// readUsersFile reads the users file, returning no users when it does not
+// exist yet and missingOK is set.
+func readUsersFile(configArgs *ConfigArguments, missingOK bool) (map[string]string, error) {
+	if configArgs.mqttUsersFile == "" {
+		return nil, fmt.Errorf("mqtt-users-file is not set")
+	}
+	users, err := mqtt.ReadUsersFile(configArgs.mqttUsersFile)
+	if os.IsNotExist(err) && missingOK {
+		return map[string]string{}, nil
+	}
+	return users, err
+}
+
+// readPassword prompts for a password twice on a terminal, or reads the first
+// line of stdin otherwise.
+func readPassword(cmd *cobra.Command) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(cmd.ErrOrStderr(), "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(cmd.ErrOrStderr())
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(cmd.ErrOrStderr(), "Repeat password: ")
+	repeated, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(cmd.ErrOrStderr())
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -2,11 +2,13 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/joho/godotenv"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -14,13 +16,18 @@ import (
 
 var (
 	envPrefix = "BP"
+
+	// commandLineFlags are the flags given on the command line. They take
+	// precedence over every other source, also when the config is reloaded.
+	commandLineFlags = map[string]bool{}
 )
 
-func InitializeConfig(cmd *cobra.Command) error {
-	v := viper.New()
+// InitializeConfig loads the configuration from the .env file, the BP_*
+// environment variables and the config file into the command's flags, and
+// returns the viper instance for reading the sections that have no flags.
+func InitializeConfig(cmd *cobra.Command) (*viper.Viper, error) {
 	// load .env file if it exists
 	if _, err := os.Stat(".env"); err == nil {
-		log.Println("hello")
 		err := godotenv.Load()
 		if err != nil {
 			log.Fatal("Error loading .env file")
@@ -28,15 +35,160 @@ func InitializeConfig(cmd *cobra.Command) error {
 
 	}
 
-	v.SetEnvPrefix(envPrefix)
-	v.AutomaticEnv()
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+
+	v, err := newViper(cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	// Bind the current command's flags to viper
 	bindFlags(cmd, v)
 
+	return v, nil
+}
+
+// ReloadConfig reads the environment and the config file again into every
+// flag that was not given on the command line. Flags that are no longer set
+// anywhere are reset to their default.
+func ReloadConfig(cmd *cobra.Command) (*viper.Viper, error) {
+	v, err := newViper(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if commandLineFlags[f.Name] || v.IsSet(f.Name) {
+			return
+		}
+		if sliceValue, ok := f.Value.(pflag.SliceValue); ok {
+			sliceValue.Replace([]string{})
+			return
+		}
+		f.Value.Set(f.DefValue)
+	})
+	bindFlags(cmd, v)
+
+	return v, nil
+}
+
+func newViper(cmd *cobra.Command) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	// Resolve dashed keys such as credentials-file from BP_CREDENTIALS_FILE
+	// before the flags are bound, as the config files are read first.
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	if err := readConfigFile(cmd, v); err != nil {
+		return nil, err
+	}
+	if err := readCredentialsFile(cmd, v); err != nil {
+		return nil, err
+	}
+	if err := readSecretFiles(cmd, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readConfigFile reads the config file given with --config (or BP_CONFIG). When
+// none is given, brightpod.yaml (or .toml, .json) is looked up in the working
+// directory and in /etc/brightpod, and it is fine for it not to exist.
+func readConfigFile(cmd *cobra.Command, v *viper.Viper) error {
+	configFile := ""
+	if flag := cmd.Flags().Lookup("config"); flag != nil {
+		configFile = flag.Value.String()
+	}
+	if configFile == "" {
+		configFile = v.GetString("config")
+	}
+
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+	} else {
+		v.SetConfigName("brightpod")
+		v.AddConfigPath(".")
+		v.AddConfigPath("/etc/brightpod")
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok && configFile == "" {
+			return nil
+		}
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	log.Printf("Using config file: %s", v.ConfigFileUsed())
+	return nil
+}
+
+// readCredentialsFile merges the file given with --credentials-file (or the
+// credentials-file key of the config file) on top of the config file, so that
+// secrets can live apart from the rest of the configuration.
+func readCredentialsFile(cmd *cobra.Command, v *viper.Viper) error {
+	credentialsFile := ""
+	if flag := cmd.Flags().Lookup("credentials-file"); flag != nil && commandLineFlags[flag.Name] {
+		credentialsFile = flag.Value.String()
+	}
+	if credentialsFile == "" {
+		credentialsFile = v.GetString("credentials-file")
+	}
+	if credentialsFile == "" {
+		return nil
+	}
+
+	credentials := viper.New()
+	credentials.SetConfigFile(credentialsFile)
+	if err := credentials.ReadInConfig(); err != nil {
+		return fmt.Errorf("could not read credentials file: %w", err)
+	}
+	if err := v.MergeConfigMap(credentials.AllSettings()); err != nil {
+		return fmt.Errorf("could not merge credentials file: %w", err)
+	}
 	return nil
 }
 
+// readSecretFiles reads the value of a flag from the file named by its
+// BP_*_FILE environment variable, e.g. BP_MQTT_PASSWORD_FILE for
+// --mqtt-password, as mounted by Docker or Kubernetes secrets. List flags take
+// one value per line.
+func readSecretFiles(cmd *cobra.Command, v *viper.Viper) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		envVar := fmt.Sprintf("%s_%s", envPrefix, strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_")))
+		path := os.Getenv(envVar + "_FILE")
+		if path == "" || err != nil {
+			return
+		}
+		if _, ok := os.LookupEnv(envVar); ok {
+			err = fmt.Errorf("only one of %s and %s_FILE can be set", envVar, envVar)
+			return
+		}
+
+		content, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			err = fmt.Errorf("could not read %s_FILE: %w", envVar, readErr)
+			return
+		}
+
+		value := strings.TrimRight(string(content), "\r\n")
+		if _, ok := f.Value.(pflag.SliceValue); ok {
+			values := []string{}
+			for _, line := range strings.Split(value, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					values = append(values, line)
+				}
+			}
+			v.Set(f.Name, values)
+			return
+		}
+		v.Set(f.Name, value)
+	})
+	return err
+}
+
 // Bind each cobra flag to its associated viper configuration (config file and environment variable)
 func bindFlags(cmd *cobra.Command, v *viper.Viper) {
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
@@ -48,9 +200,23 @@ func bindFlags(cmd *cobra.Command, v *viper.Viper) {
 		}
 
 		// Apply the viper config value to the flag when the flag is not set and viper has a value
-		if !f.Changed && v.IsSet(f.Name) {
+		if !commandLineFlags[f.Name] && v.IsSet(f.Name) {
 			val := v.Get(f.Name)
+			// Lists from the config file are set as is, while strings from
+			// the environment are parsed by the flag itself.
+			if sliceValue, ok := f.Value.(pflag.SliceValue); ok && isList(val) {
+				sliceValue.Replace(cast.ToStringSlice(val))
+				return
+			}
 			cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
 		}
 	})
 }
+
+func isList(val interface{}) bool {
+	switch val.(type) {
+	case []interface{}, []string:
+		return true
+	}
+	return false
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"brightpod/cmd"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	cmd := cmd.NewRootCommand()
-	if err := cmd.Execute(); err != nil {
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		stop()
 		os.Exit(1)
 	}
-
-	os.Exit(1)
-
 }
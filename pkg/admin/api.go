@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"brightpod/pkg/api"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegisterAPI adds the user management endpoints to the HTTP API:
+//
+//	GET    /api/users             lists the users
+//	PUT    /api/users/<username>  {"password": "..."} adds a user or changes its password
+//	DELETE /api/users/<username>  removes a user and disconnects its sessions
+//	GET    /api/pairing           tells until when devices are paired
+//	POST   /api/pairing           {"duration": "5m"}, optional, starts pairing
+//	DELETE /api/pairing           stops pairing
+func (users *Users) RegisterAPI(server *api.Server) {
+	server.HandleFunc("/api/pairing", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body struct {
+				Duration string `json:"duration"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+				api.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			duration := DefaultPairingDuration
+			if body.Duration != "" {
+				parsed, err := time.ParseDuration(body.Duration)
+				if err != nil {
+					api.WriteError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				duration = parsed
+			}
+			if _, err := users.StartPairing(duration); err != nil {
+				writeError(w, err)
+				return
+			}
+		case http.MethodDelete:
+			users.StopPairing()
+		default:
+			api.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		status := map[string]interface{}{"active": false}
+		if until := users.PairingUntil(); !until.IsZero() {
+			status["active"] = true
+			status["until"] = until.Format(time.RFC3339)
+		}
+		api.WriteJSON(w, http.StatusOK, status)
+	})
+
+	server.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			api.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		api.WriteJSON(w, http.StatusOK, users.List())
+	})
+
+	server.HandleFunc("/api/users/", func(w http.ResponseWriter, r *http.Request) {
+		username := strings.TrimPrefix(r.URL.Path, "/api/users/")
+		if username == "" || strings.Contains(username, "/") {
+			api.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				Password string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				api.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			added, err := users.SetPassword(username, body.Password)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			status := http.StatusOK
+			if added {
+				status = http.StatusCreated
+			}
+			api.WriteJSON(w, status, map[string]string{"user": username})
+		case http.MethodDelete:
+			if err := users.Delete(username); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			api.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNoUser):
+		api.WriteError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrStaticUser), errors.Is(err, ErrNoUsersFile):
+		api.WriteError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalid):
+		api.WriteError(w, http.StatusBadRequest, err.Error())
+	default:
+		api.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"log"
+	"time"
+
+	"github.com/mochi-co/hanami"
+)
+
+const (
+	// TopicPrefix is the root of the admin topics. Only users with write
+	// access to it, by default the user brightpod connects with, can use them.
+	TopicPrefix = "$brightpod/admin"
+)
+
+// Subscribe handles user management and pairing on the admin topics:
+//
+//	$brightpod/admin/users/<username>/set     {"password": "..."}
+//	$brightpod/admin/users/<username>/delete
+//	$brightpod/admin/users/list
+//	$brightpod/admin/pairing/start            {"duration": "5m"}, optional
+//	$brightpod/admin/pairing/stop
+//
+// The result is sent to the $reply topic of the request, or published to
+// $brightpod/admin/result.
+func (users *Users) Subscribe(client *hanami.Client) error {
+	err := client.Subscribe("admin", TopicPrefix+"/users/+/+", 0, false, func(in *hanami.Payload) {
+		users.handleUser(client, in)
+	})
+	if err != nil {
+		return err
+	}
+	err = client.Subscribe("admin", TopicPrefix+"/users/list", 0, false, func(in *hanami.Payload) {
+		reply(client, in, hanami.Msg{"action": "list", "users": users.List()})
+	})
+	if err != nil {
+		return err
+	}
+	return client.Subscribe("admin", TopicPrefix+"/pairing/+", 0, false, func(in *hanami.Payload) {
+		users.handlePairing(client, in)
+	})
+}
+
+func (users *Users) handlePairing(client *hanami.Client, in *hanami.Payload) {
+	action := in.Elements[0]
+	result := hanami.Msg{"action": "pairing/" + action}
+
+	switch action {
+	case "start":
+		duration := DefaultPairingDuration
+		if value, ok := in.Msg["duration"].(string); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				result["error"] = err.Error()
+				reply(client, in, result)
+				return
+			}
+			duration = parsed
+		}
+		until, err := users.StartPairing(duration)
+		if err != nil {
+			log.Printf("Could not start pairing: %s", err)
+			result["error"] = err.Error()
+		} else {
+			result["until"] = until.Format(time.RFC3339)
+		}
+	case "stop":
+		users.StopPairing()
+	default:
+		log.Printf("Unknown admin pairing action %s", action)
+		return
+	}
+	reply(client, in, result)
+}
+
+func (users *Users) handleUser(client *hanami.Client, in *hanami.Payload) {
+	username, action := in.Elements[0], in.Elements[1]
+	result := hanami.Msg{"action": action, "user": username}
+
+	var err error
+	switch action {
+	case "set":
+		password, _ := in.Msg["password"].(string)
+		var added bool
+		added, err = users.SetPassword(username, password)
+		result["added"] = added
+	case "delete":
+		err = users.Delete(username)
+	default:
+		log.Printf("Unknown admin action %s for user %s", action, username)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Could not %s user %s: %s", action, username, err)
+		result["error"] = err.Error()
+	}
+	reply(client, in, result)
+}
+
+func reply(client *hanami.Client, in *hanami.Payload, result hanami.Msg) {
+	var err error
+	if in.ReplyTo != "" {
+		_, err = client.Reply(in, 0, false, result)
+	} else {
+		_, err = client.Publish(TopicPrefix+"/result", 0, false, result)
+	}
+	if err != nil {
+		log.Printf("Could not publish admin result: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ReadPairedDevices reads the IDs of the devices paired at runtime, one per
+// line. A file that does not exist yet holds no devices.
+func ReadPairedDevices(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ids := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids, scanner.Err()
+}
+
+// SetPairedFile sets the file the IDs of paired devices are saved to, so that
+// they stay declared after a restart. Nothing is saved when it is empty.
+func (users *Users) SetPairedFile(path string) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	users.pairedFile = path
+}
+
+// updatePaired adds or removes a device in the paired file.
+func (users *Users) updatePaired(id string, paired bool) error {
+	if users.pairedFile == "" {
+		return nil
+	}
+	ids, err := ReadPairedDevices(users.pairedFile)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	for _, existing := range ids {
+		set[existing] = true
+	}
+	if set[id] == paired {
+		return nil
+	}
+	if paired {
+		set[id] = true
+	} else {
+		delete(set, id)
+	}
+
+	ids = make([]string, 0, len(set))
+	for existing := range set {
+		ids = append(ids, existing)
+	}
+	sort.Strings(ids)
+	content := ""
+	for _, existing := range ids {
+		content += existing + "\n"
+	}
+	return ioutil.WriteFile(users.pairedFile, []byte(content), 0600)
+}
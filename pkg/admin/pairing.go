@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPairingDuration is how long pairing lasts when no duration is given.
+	DefaultPairingDuration = 5 * time.Minute
+	// MaxPairingDuration is the longest pairing can last.
+	MaxPairingDuration = time.Hour
+)
+
+// pairableUsername matches the usernames that look like a blower ID: up to
+// 32 lowercase letters, digits, dashes and underscores. Pair also requires a
+// digit, which keeps names such as admin or bridge from being paired.
+var pairableUsername = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// StartPairing accepts devices with unknown usernames until the duration
+// passes, see Pair, and returns when pairing ends.
+func (users *Users) StartPairing(duration time.Duration) (time.Time, error) {
+	if duration <= 0 || duration > MaxPairingDuration {
+		return time.Time{}, fmt.Errorf("%w: pairing must last more than 0 and at most %s, recieved: %s", ErrInvalid, MaxPairingDuration, duration)
+	}
+
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	if users.usersFile == "" {
+		return time.Time{}, ErrNoUsersFile
+	}
+	users.pairingUntil = time.Now().Add(duration)
+	log.Printf("Pairing new devices until %s", users.pairingUntil.Format(time.RFC3339))
+	return users.pairingUntil, nil
+}
+
+// StopPairing ends pairing right away.
+func (users *Users) StopPairing() {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	if users.pairing() {
+		log.Printf("Stopped pairing new devices")
+	}
+	users.pairingUntil = time.Time{}
+}
+
+// PairingUntil returns when pairing ends, or the zero time when it is not
+// active.
+func (users *Users) PairingUntil() time.Time {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	if !users.pairing() {
+		return time.Time{}
+	}
+	return users.pairingUntil
+}
+
+// OnPaired sets a function called with the username of every paired device.
+func (users *Users) OnPaired(onPaired func(username string)) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	users.onPaired = onPaired
+}
+
+// Pair is the unknown user handler of the server. While pairing, it adds an
+// unknown user to the users file with the password it connected with, so the
+// device keeps the credentials set in its firmware, and saves it to the
+// paired file. Only usernames that look like a blower ID are paired, and users
+// that already exist are never changed.
+func (users *Users) Pair(username, password string) bool {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+
+	if !users.pairing() {
+		return false
+	}
+	if password == "" || !pairableUsername.MatchString(username) || !strings.ContainsAny(username, "0123456789") {
+		log.Printf("Not pairing device with invalid username %q", username)
+		return false
+	}
+	added, err := users.setPassword(username, password, false)
+	if err != nil {
+		log.Printf("Could not pair device %s: %s", username, err)
+		return false
+	}
+	if !added {
+		log.Printf("Not pairing device %s, the user already exists", username)
+		return false
+	}
+	if err := users.updatePaired(username, true); err != nil {
+		log.Printf("Could not save paired device %s, it is declared until brightpod restarts: %s", username, err)
+	}
+	log.Printf("Paired new device: %s", username)
+	if users.onPaired != nil {
+		users.onPaired(username)
+	}
+	return true
+}
+
+func (users *Users) pairing() bool {
+	return time.Now().Before(users.pairingUntil)
+}
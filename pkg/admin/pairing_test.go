@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"brightpod/pkg/mqtt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestUsers(t *testing.T) *Users {
+	dir := t.TempDir()
+	users := NewUsers(mqtt.New(nil), filepath.Join(dir, "users"))
+	users.SetPairedFile(filepath.Join(dir, "paired"))
+	users.SetStatic([]string{"brightpod"})
+	return users
+}
+
+func TestPairOnlyWhilePairing(t *testing.T) {
+	users := newTestUsers(t)
+
+	if users.Pair("fan1", "secret") {
+		t.Fatalf("paired a device before pairing started")
+	}
+	if _, err := users.StartPairing(0); err == nil {
+		t.Errorf("started pairing without a duration")
+	}
+	if _, err := users.StartPairing(MaxPairingDuration + time.Second); err == nil {
+		t.Errorf("started pairing for longer than %s", MaxPairingDuration)
+	}
+
+	until, err := users.StartPairing(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.PairingUntil().Equal(until) {
+		t.Errorf("pairing until %s, want %s", users.PairingUntil(), until)
+	}
+	if !users.Pair("fan1", "secret") {
+		t.Fatalf("did not pair a device while pairing")
+	}
+
+	users.StopPairing()
+	if !users.PairingUntil().IsZero() {
+		t.Errorf("still pairing after StopPairing")
+	}
+	if users.Pair("fan2", "secret") {
+		t.Errorf("paired a device after pairing stopped")
+	}
+
+	users.pairingUntil = time.Now().Add(-time.Second)
+	if users.Pair("fan3", "secret") {
+		t.Errorf("paired a device after pairing expired")
+	}
+}
+
+func TestPairAddsUser(t *testing.T) {
+	users := newTestUsers(t)
+	var paired []string
+	users.OnPaired(func(username string) {
+		paired = append(paired, username)
+	})
+	if _, err := users.StartPairing(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if !users.Pair("fan1", "secret") {
+		t.Fatalf("did not pair fan1")
+	}
+	if len(paired) != 1 || paired[0] != "fan1" {
+		t.Errorf("paired handler called with %v", paired)
+	}
+	fileUsers, err := mqtt.ReadUsersFile(users.usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mqtt.CheckPassword(fileUsers["fan1"], "secret") {
+		t.Errorf("users file does not hold the password fan1 connected with")
+	}
+	if list := users.List(); len(list) != 1 || list[0] != "fan1" {
+		t.Errorf("server users = %v", list)
+	}
+	ids, err := ReadPairedDevices(users.pairedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "fan1" {
+		t.Errorf("paired devices = %v", ids)
+	}
+
+	if err := users.Delete("fan1"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := ReadPairedDevices(users.pairedFile); len(ids) != 0 {
+		t.Errorf("paired devices after deleting the user = %v", ids)
+	}
+}
+
+func TestPairRejectsInvalidUsernames(t *testing.T) {
+	users := newTestUsers(t)
+	if _, err := users.StartPairing(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{
+		"", "fan:1", "fans/1", "fan+", "fan#", "$SYS",
+		"admin", "bridge", "Fan1", "fan 1", "fan1-with-a-name-much-too-long-for-an-id",
+	} {
+		if users.Pair(username, "secret") {
+			t.Errorf("paired device with invalid username %q", username)
+		}
+	}
+	if users.Pair("fan1", "") {
+		t.Errorf("paired device without a password")
+	}
+	if !users.Pair("bp-3fa2c1", "secret") {
+		t.Errorf("did not pair a device with a blower ID")
+	}
+	if len(users.List()) != 1 {
+		t.Errorf("invalid devices were added: %v", users.List())
+	}
+}
+
+func TestPairKeepsExistingUsers(t *testing.T) {
+	users := newTestUsers(t)
+	if _, err := users.SetPassword("fan1", "original"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.StartPairing(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if users.Pair("fan1", "other") {
+		t.Errorf("paired over an existing user")
+	}
+	if users.Pair("brightpod", "other") {
+		t.Errorf("paired over a static user")
+	}
+	fileUsers, err := mqtt.ReadUsersFile(users.usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mqtt.CheckPassword(fileUsers["fan1"], "original") {
+		t.Errorf("pairing changed the password of an existing user")
+	}
+	if _, ok := fileUsers["brightpod"]; ok {
+		t.Errorf("pairing added a static user to the users file")
+	}
+	if ids, _ := ReadPairedDevices(users.pairedFile); len(ids) != 0 {
+		t.Errorf("existing users were saved as paired: %v", ids)
+	}
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"brightpod/pkg/mqtt"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoUsersFile is returned when there is no users file to save changes to.
+	ErrNoUsersFile = errors.New("users can only be managed at runtime with mqtt-users-file set")
+	// ErrStaticUser is returned for users that come from flags or the
+	// environment, which cannot be changed at runtime.
+	ErrStaticUser = errors.New("user is not declared in the users file")
+	// ErrNoUser is returned when deleting a user that does not exist.
+	ErrNoUser = errors.New("no such user")
+	// ErrInvalid is wrapped by errors about invalid requests, such as an
+	// empty password.
+	ErrInvalid = errors.New("invalid request")
+)
+
+// Users manages the users of the built-in mqtt server at runtime. Every change
+// is saved to the users file before it is applied, so that it survives
+// reloads and restarts.
+type Users struct {
+	lock       sync.Mutex
+	server     *mqtt.Server
+	usersFile  string
+	pairedFile string
+	static     map[string]bool
+
+	pairingUntil time.Time
+	onPaired     func(username string)
+}
+
+// NewUsers returns a manager of the users of the server, saving to the users
+// file, which may be empty to refuse every change.
+func NewUsers(server *mqtt.Server, usersFile string) *Users {
+	return &Users{
+		server:    server,
+		usersFile: usersFile,
+		static:    map[string]bool{},
+	}
+}
+
+// SetStatic sets the users that do not come from the users file.
+func (users *Users) SetStatic(usernames []string) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	users.static = map[string]bool{}
+	for _, username := range usernames {
+		users.static[username] = true
+	}
+}
+
+// SetPassword adds a user or changes its password, returning whether the user
+// was added.
+func (users *Users) SetPassword(username, password string) (bool, error) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+
+	if username == "" || strings.Contains(username, ":") {
+		return false, fmt.Errorf("%w: username %q cannot be empty or contain ':'", ErrInvalid, username)
+	}
+	if password == "" {
+		return false, fmt.Errorf("%w: password cannot be empty", ErrInvalid)
+	}
+	return users.setPassword(username, password, true)
+}
+
+// setPassword leaves an existing user as it is unless replace is set.
+func (users *Users) setPassword(username, password string, replace bool) (bool, error) {
+	fileUsers, err := users.read()
+	if err != nil {
+		return false, err
+	}
+	if users.static[username] {
+		return false, ErrStaticUser
+	}
+	_, exists := fileUsers[username]
+	if exists && !replace {
+		return false, nil
+	}
+
+	hash, err := mqtt.HashPassword(password)
+	if err != nil {
+		return false, err
+	}
+	fileUsers[username] = hash
+	if err := mqtt.WriteUsersFile(users.usersFile, fileUsers); err != nil {
+		return false, err
+	}
+	users.server.ConfigureUser(username, hash)
+	return !exists, nil
+}
+
+// Delete removes a user and disconnects its sessions.
+func (users *Users) Delete(username string) error {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+
+	fileUsers, err := users.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := fileUsers[username]; !ok {
+		if users.static[username] {
+			return ErrStaticUser
+		}
+		return ErrNoUser
+	}
+
+	delete(fileUsers, username)
+	if err := mqtt.WriteUsersFile(users.usersFile, fileUsers); err != nil {
+		return err
+	}
+	users.server.DeleteUser(username)
+	if err := users.updatePaired(username, false); err != nil {
+		log.Printf("Could not remove %s from the paired devices: %s", username, err)
+	}
+	return nil
+}
+
+// List returns the names of every user of the server.
+func (users *Users) List() []string {
+	usernames := users.server.Users()
+	sort.Strings(usernames)
+	return usernames
+}
+
+func (users *Users) read() (map[string]string, error) {
+	if users.usersFile == "" {
+		return nil, ErrNoUsersFile
+	}
+	fileUsers, err := mqtt.ReadUsersFile(users.usersFile)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	return fileUsers, err
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Server is a small JSON HTTP API exposing the internals of brightpod.
+type Server struct {
+	address string
+	token   string
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+func New(address string, token string) *Server {
+	return &Server{
+		address: address,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+}
+
+// HandleFunc registers a handler for the given pattern. Every request must
+// carry the configured bearer token when one is set.
+func (server *Server) HandleFunc(pattern string, handler http.HandlerFunc) {
+	server.mux.HandleFunc(pattern, server.authorize(handler))
+}
+
+func (server *Server) Start() {
+	server.server = &http.Server{
+		Addr:    server.address,
+		Handler: server.mux,
+	}
+	go func() {
+		err := server.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("API server stopped: %s", err)
+		}
+	}()
+}
+
+// Shutdown stops the server, waiting for the requests in progress until the
+// context is done.
+func (server *Server) Shutdown(ctx context.Context) error {
+	if server.server == nil {
+		return nil
+	}
+	return server.server.Shutdown(ctx)
+}
+
+func (server *Server) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+				WriteError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// WriteJSON writes the given value as a JSON response.
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Could not write API response: %s", err)
+	}
+}
+
+// WriteError writes an error message as a JSON response.
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]string{"error": message})
+}
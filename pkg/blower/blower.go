@@ -3,20 +3,59 @@ package blower
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Blower is the state of a blower. It is safe for concurrent use, and every
+// change is reported to its change handler.
 type Blower struct {
+	lock             sync.RWMutex
+	onChange         func(Change)
 	id               string
+	profile          Profile
 	firmwareVersion  float64
 	firmwareRevision float64
-	IsFanRunning     bool
+	running          bool
 	mode             string
 	fs               float64
 	fanPower         int
 	rpm              int
 	temperature      float64
 	lastKeepAlive    time.Time
+	uptime           int64
+	diffStart        int64
+	diffStop         int64
+	reboots          int
+	lastReboot       time.Time
+}
+
+const (
+	MaxFanPower    = 12
+	MaxRPM         = 6000
+	MinTemperature = 15.0
+	MaxTemperature = 30.0
+)
+
+// Settings holds the user controllable values of a blower. Fields left as nil
+// are not changed when the settings are applied.
+type Settings struct {
+	Mode        *string  `json:"mode,omitempty"`
+	FanPower    *int     `json:"power,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// KeepAlive is the state a blower reports with each keepalive.
+type KeepAlive struct {
+	// Mode is the mode the blower runs in, nil keeps the current mode. A
+	// rebooted blower reports its own defaults, so its mode is ignored.
+	Mode    *int
+	Running bool
+	// Extended is set when the uptime counters below were reported.
+	Extended  bool
+	Uptime    int64
+	DiffStart int64
+	DiffStop  int64
 }
 
 var BLOWER_MODES = map[int]string{
@@ -42,14 +81,21 @@ func ModeAsInt(mode string) (int, error) {
 	return 0, fmt.Errorf("Blower mode: %s does not exist", mode)
 }
 
-func New(id string, fanPower int, temperature float64, rpm int, firmwareVersion, firmwareRevision, fs float64) (*Blower, error) {
+func New(id string, profile Profile, rpm int, firmwareVersion, firmwareRevision, fs float64) (*Blower, error) {
 	blower := &Blower{
 		id:               id,
+		profile:          profile,
 		firmwareVersion:  firmwareVersion,
 		firmwareRevision: firmwareRevision,
 		fs:               fs,
 	}
-	if err := blower.SetFanPower(fanPower); err != nil {
+	if profile.Defaults.Mode != "" {
+		if err := blower.SetModeFromString(profile.Defaults.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := blower.SetFanPower(profile.Defaults.Power); err != nil {
 		return nil, err
 	}
 
@@ -57,16 +103,49 @@ func New(id string, fanPower int, temperature float64, rpm int, firmwareVersion,
 		return nil, err
 	}
 
-	if err := blower.SetTemperature(temperature); err != nil {
+	if err := blower.SetTemperature(profile.Defaults.Temperature); err != nil {
 		return nil, err
 	}
 
 	return blower, nil
 }
 
+// SetChangeHandler sets the function called after every change of the
+// blower, outside of its lock.
+func (blower *Blower) SetChangeHandler(handler func(Change)) {
+	blower.lock.Lock()
+	blower.onChange = handler
+	blower.lock.Unlock()
+}
+
+// update runs a mutation under the lock and reports the fields it changed.
+func (blower *Blower) update(mutate func() ([]Field, error)) error {
+	blower.lock.Lock()
+	fields, err := mutate()
+	handler := blower.onChange
+	var change Change
+	if len(fields) > 0 {
+		change = Change{
+			ID:     blower.id,
+			Fields: fields,
+			State:  blower.state(),
+			Time:   time.Now(),
+		}
+	}
+	blower.lock.Unlock()
+
+	if handler != nil && len(fields) > 0 {
+		handler(change)
+	}
+	return err
+}
+
 func (blower *Blower) GenerateStausPayload() string {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+
 	fanRunningFlag := 0
-	if blower.IsFanRunning {
+	if blower.running {
 		fanRunningFlag = 1
 	}
 	mode, _ := ModeAsInt(blower.mode) // ignore errors because we know it's already set proper
@@ -81,24 +160,35 @@ func (blower *Blower) GenerateStausPayload() string {
 }
 
 func (blower *Blower) SetModeFromString(mode string) error {
-	if _, err := ModeAsInt(mode); err == nil {
-		blower.mode = mode
-		return nil
-	} else {
+	if _, err := ModeAsInt(mode); err != nil {
 		return err
 	}
+	return blower.update(func() ([]Field, error) {
+		return blower.setMode(mode), nil
+	})
 }
 
 func (blower *Blower) SetModeFromInt(mode int) error {
-	if modeStr, err := ModeAsString(mode); err == nil {
-		blower.mode = modeStr
-		return nil
-	} else {
+	modeStr, err := ModeAsString(mode)
+	if err != nil {
 		return err
 	}
+	return blower.update(func() ([]Field, error) {
+		return blower.setMode(modeStr), nil
+	})
+}
+
+func (blower *Blower) setMode(mode string) []Field {
+	if blower.mode == mode {
+		return nil
+	}
+	blower.mode = mode
+	return []Field{FieldMode}
 }
 
 func (blower *Blower) Mode() string {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
 	return blower.mode
 }
 
@@ -106,30 +196,205 @@ func (blower *Blower) ID() string {
 	return blower.id
 }
 
+func (blower *Blower) Profile() Profile {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.profile
+}
+
+// SetProfile replaces the profile of the blower. The current settings are
+// kept even if they fall outside of the new ranges.
+func (blower *Blower) SetProfile(profile Profile) {
+	blower.update(func() ([]Field, error) {
+		if blower.profile == profile {
+			return nil, nil
+		}
+		blower.profile = profile
+		return []Field{FieldProfile}, nil
+	})
+}
+
+// IsFanRunning reports whether the blower said its fan is running.
+func (blower *Blower) IsFanRunning() bool {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.running
+}
+
+func (blower *Blower) FanPower() int {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.fanPower
+}
+
+// FanPowerPercentage returns the fan power relative to the power steps of the blower.
+func (blower *Blower) FanPowerPercentage() int {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.fanPower * 100 / blower.profile.PowerSteps
+}
+
+func (blower *Blower) Temperature() float64 {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.temperature
+}
+
+func (blower *Blower) FirmwareVersion() string {
+	return fmt.Sprintf("%v.%v", blower.firmwareVersion, blower.firmwareRevision)
+}
+
+// Apply validates every field of the given settings and only then updates the
+// blower, so an invalid field leaves the blower untouched.
+func (blower *Blower) Apply(settings Settings) error {
+	return blower.update(func() ([]Field, error) {
+		if err := blower.profile.ValidateSettings(settings); err != nil {
+			return nil, err
+		}
+
+		var fields []Field
+		if settings.Mode != nil {
+			fields = append(fields, blower.setMode(*settings.Mode)...)
+		}
+		if settings.FanPower != nil && *settings.FanPower != blower.fanPower {
+			blower.fanPower = *settings.FanPower
+			fields = append(fields, FieldFanPower)
+		}
+		if settings.Temperature != nil && *settings.Temperature != blower.temperature {
+			blower.temperature = *settings.Temperature
+			fields = append(fields, FieldTemperature)
+		}
+		return fields, nil
+	})
+}
+
 func (blower *Blower) SetFanPower(power int) error {
-	if power < 0 || power > 12 {
-		return fmt.Errorf("fan power must be postive and less than 12, recieved: %d", power)
-	}
-	blower.fanPower = power
-	return nil
+	return blower.update(func() ([]Field, error) {
+		if err := blower.profile.validateFanPower(power); err != nil {
+			return nil, err
+		}
+		if blower.fanPower == power {
+			return nil, nil
+		}
+		blower.fanPower = power
+		return []Field{FieldFanPower}, nil
+	})
 }
 
 func (blower *Blower) SetRPM(rpm int) error {
-	if rpm > 6000 {
-		return fmt.Errorf("fan rpm must be less than 6000, recieved: %d", rpm)
+	if rpm > MaxRPM {
+		return fmt.Errorf("fan rpm must be less than %d, recieved: %d", MaxRPM, rpm)
 	}
-	blower.rpm = rpm
-	return nil
+	return blower.update(func() ([]Field, error) {
+		if blower.rpm == rpm {
+			return nil, nil
+		}
+		blower.rpm = rpm
+		return []Field{FieldRPM}, nil
+	})
 }
 
 func (blower *Blower) SetTemperature(temp float64) error {
-	if temp > 30 || temp < 15 {
-		return fmt.Errorf("fan rpm must be less than 30 and more than 15, recieved: %f", temp)
-	}
-	blower.temperature = temp
-	return nil
+	return blower.update(func() ([]Field, error) {
+		if err := blower.profile.validateTemperature(temp); err != nil {
+			return nil, err
+		}
+		if blower.temperature == temp {
+			return nil, nil
+		}
+		blower.temperature = temp
+		return []Field{FieldTemperature}, nil
+	})
 }
 
+// UpdateLastContact refreshes the last contact, which is not reported as a
+// change as it moves with every message of the blower.
 func (blower *Blower) UpdateLastContact() {
+	blower.lock.Lock()
+	defer blower.lock.Unlock()
 	blower.lastKeepAlive = time.Now()
 }
+
+// UpdateUptime records the milliseconds since boot reported by the blower and
+// the counters that accompany it. A counter lower than the previous one means
+// the blower rebooted in between, which is reported back to the caller. The
+// uptime is only reported as a change along with a reboot.
+func (blower *Blower) UpdateUptime(uptime, diffStart, diffStop int64) bool {
+	var rebooted bool
+	blower.update(func() ([]Field, error) {
+		var fields []Field
+		rebooted, fields = blower.setUptime(uptime, diffStart, diffStop)
+		return fields, nil
+	})
+	return rebooted
+}
+
+func (blower *Blower) setUptime(uptime, diffStart, diffStop int64) (bool, []Field) {
+	var fields []Field
+	rebooted := blower.uptime > 0 && uptime < blower.uptime
+	if rebooted {
+		blower.reboots++
+		blower.lastReboot = time.Now()
+		fields = append(fields, FieldReboots, FieldUptime)
+	}
+	blower.uptime = uptime
+	blower.diffStart = diffStart
+	blower.diffStop = diffStop
+	return rebooted, fields
+}
+
+// ReportKeepAlive records a keepalive as a single change, and refreshes the
+// last contact. Only the fields that changed are reported, so a keepalive of
+// a blower that kept running as it was changes nothing. It reports whether
+// the blower rebooted since the previous keepalive. An unknown mode leaves
+// the blower untouched.
+func (blower *Blower) ReportKeepAlive(keepAlive KeepAlive) (bool, error) {
+	mode := ""
+	if keepAlive.Mode != nil {
+		var err error
+		if mode, err = ModeAsString(*keepAlive.Mode); err != nil {
+			return false, err
+		}
+	}
+
+	rebooted := false
+	err := blower.update(func() ([]Field, error) {
+		var fields []Field
+		if keepAlive.Extended {
+			rebooted, fields = blower.setUptime(keepAlive.Uptime, keepAlive.DiffStart, keepAlive.DiffStop)
+		}
+		if mode != "" && !rebooted {
+			fields = append(fields, blower.setMode(mode)...)
+		}
+		if blower.running != keepAlive.Running {
+			blower.running = keepAlive.Running
+			fields = append(fields, FieldRunning)
+		}
+		blower.lastKeepAlive = time.Now()
+		return fields, nil
+	})
+	return rebooted, err
+}
+
+func (blower *Blower) Uptime() time.Duration {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return time.Duration(blower.uptime) * time.Millisecond
+}
+
+func (blower *Blower) Reboots() int {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.reboots
+}
+
+func (blower *Blower) LastContact() time.Time {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.lastKeepAlive
+}
+
+// IsOnline reports whether the blower sent a keepalive within the given timeout.
+func (blower *Blower) IsOnline(timeout time.Duration) bool {
+	return time.Since(blower.LastContact()) <= timeout
+}
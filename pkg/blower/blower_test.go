@@ -0,0 +1,252 @@
+package blower
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBlower(t *testing.T) *Blower {
+	blwr, err := New("fan1", DefaultProfile(), MaxRPM, 1, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blwr
+}
+
+func uptimeKeepAlive(uptime int64, mode int) KeepAlive {
+	return KeepAlive{Mode: &mode, Running: true, Extended: true, Uptime: uptime}
+}
+
+func TestReportKeepAliveDetectsReboots(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous int64
+		uptime   int64
+		rebooted bool
+	}{
+		{name: "first keepalive", previous: 0, uptime: 5000, rebooted: false},
+		{name: "starting from zero", previous: 0, uptime: 0, rebooted: false},
+		{name: "uptime going up", previous: 5000, uptime: 15000, rebooted: false},
+		{name: "uptime staying the same", previous: 5000, uptime: 5000, rebooted: false},
+		{name: "uptime going down", previous: 5000, uptime: 1000, rebooted: true},
+		{name: "uptime back at zero", previous: 5000, uptime: 0, rebooted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blwr := newTestBlower(t)
+			if tt.previous > 0 {
+				if _, err := blwr.ReportKeepAlive(uptimeKeepAlive(tt.previous, 3)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rebooted, err := blwr.ReportKeepAlive(uptimeKeepAlive(tt.uptime, 3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rebooted != tt.rebooted {
+				t.Errorf("rebooted = %v, want %v", rebooted, tt.rebooted)
+			}
+			state := blwr.Snapshot()
+			wantReboots := 0
+			if tt.rebooted {
+				wantReboots = 1
+			}
+			if state.Reboots != wantReboots {
+				t.Errorf("reboots = %d, want %d", state.Reboots, wantReboots)
+			}
+			if tt.rebooted == state.LastReboot.IsZero() {
+				t.Errorf("last reboot = %s, want it set only after a reboot", state.LastReboot)
+			}
+			if state.Uptime.Milliseconds() != tt.uptime {
+				t.Errorf("uptime = %s, want %dms", state.Uptime, tt.uptime)
+			}
+		})
+	}
+}
+
+func TestReportKeepAliveKeepsModeAfterReboot(t *testing.T) {
+	blwr := newTestBlower(t)
+	if _, err := blwr.ReportKeepAlive(uptimeKeepAlive(5000, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if blwr.Mode() != "on" {
+		t.Fatalf("mode = %s, want the reported mode on", blwr.Mode())
+	}
+
+	// The rebooted blower reports its own default mode, eco.
+	rebooted, err := blwr.ReportKeepAlive(uptimeKeepAlive(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebooted {
+		t.Fatalf("reboot not detected")
+	}
+	if blwr.Mode() != "on" {
+		t.Errorf("mode = %s after a reboot, want the mode it had before", blwr.Mode())
+	}
+
+	if _, err := blwr.ReportKeepAlive(uptimeKeepAlive(5100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if blwr.Mode() != "eco" {
+		t.Errorf("mode = %s, want the reported mode once the blower runs again", blwr.Mode())
+	}
+}
+
+func TestReportKeepAliveWithoutUptime(t *testing.T) {
+	blwr := newTestBlower(t)
+	mode := 1
+	for i := 0; i < 2; i++ {
+		rebooted, err := blwr.ReportKeepAlive(KeepAlive{Mode: &mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rebooted {
+			t.Errorf("reboot detected without uptime counters")
+		}
+	}
+}
+
+func TestReportKeepAliveRejectsUnknownMode(t *testing.T) {
+	blwr := newTestBlower(t)
+	before := blwr.Snapshot()
+	if _, err := blwr.ReportKeepAlive(uptimeKeepAlive(5000, 7)); err == nil {
+		t.Fatalf("expected an error for an unknown mode")
+	}
+	if after := blwr.Snapshot(); after != before {
+		t.Errorf("an unknown mode changed the blower: %+v", after)
+	}
+}
+
+// recordChanges returns the fields of every change of the blower so far.
+func recordChanges(blwr *Blower) func() [][]Field {
+	var lock sync.Mutex
+	changes := [][]Field{}
+	blwr.SetChangeHandler(func(change Change) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, change.Fields)
+	})
+	return func() [][]Field {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]Field{}, changes...)
+	}
+}
+
+func equalFields(fields, want []Field) bool {
+	if len(fields) != len(want) {
+		return false
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReportKeepAliveChangeFields(t *testing.T) {
+	blwr := newTestBlower(t)
+	changes := recordChanges(blwr)
+	stopped := uptimeKeepAlive(25000, 0)
+	stopped.Running = false
+
+	steps := []struct {
+		name      string
+		keepAlive KeepAlive
+		want      []Field
+	}{
+		{"first keepalive", uptimeKeepAlive(5000, 1), []Field{FieldMode, FieldRunning}},
+		{"nothing but the uptime moved", uptimeKeepAlive(15000, 1), nil},
+		{"reboot", uptimeKeepAlive(1000, 0), []Field{FieldReboots, FieldUptime}},
+		{"mode after the reboot", uptimeKeepAlive(2000, 0), []Field{FieldMode}},
+		{"stopped", stopped, []Field{FieldRunning}},
+	}
+	for _, step := range steps {
+		before := len(changes())
+		if _, err := blwr.ReportKeepAlive(step.keepAlive); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		all := changes()
+		if step.want == nil {
+			if len(all) != before {
+				t.Errorf("%s: reported %v, want no change", step.name, all[before:])
+			}
+			continue
+		}
+		if len(all) != before+1 || !equalFields(all[before], step.want) {
+			t.Errorf("%s: reported %v, want a single change of %v", step.name, all[before:], step.want)
+		}
+	}
+}
+
+func TestUpdateLastContactIsNotAChange(t *testing.T) {
+	blwr := newTestBlower(t)
+	changes := recordChanges(blwr)
+	blwr.UpdateLastContact()
+	if all := changes(); len(all) != 0 {
+		t.Errorf("reported %v, want no change", all)
+	}
+	if blwr.Snapshot().LastContact.IsZero() {
+		t.Errorf("last contact was not refreshed")
+	}
+}
+
+// TestConcurrentUpdates is meant to run with -race.
+func TestConcurrentUpdates(t *testing.T) {
+	blwr := newTestBlower(t)
+	changes := recordChanges(blwr)
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				f(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		if err := blwr.SetFanPower(i % (blwr.Profile().PowerSteps + 1)); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		mode := []string{"eco", "on", "auto"}[i%3]
+		if err := blwr.Apply(Settings{Mode: &mode}); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		if _, err := blwr.ReportKeepAlive(uptimeKeepAlive(int64(i+1)*1000, i%4)); err != nil {
+			t.Error(err)
+		}
+	})
+	run(func(i int) {
+		state := blwr.Snapshot()
+		if state.FanPower < 0 || state.FanPower > state.Profile.PowerSteps {
+			t.Errorf("snapshot with power %d", state.FanPower)
+		}
+		blwr.UpdateLastContact()
+	})
+	wg.Wait()
+
+	for _, fields := range changes() {
+		if len(fields) == 0 {
+			t.Fatalf("a change without fields was reported")
+		}
+		for _, field := range fields {
+			if field == FieldUptime || field == FieldReboots {
+				t.Errorf("reported %v without a reboot", fields)
+			}
+		}
+	}
+	if state := blwr.Snapshot(); state.Reboots != 0 || state.Uptime != 200*time.Second {
+		t.Errorf("uptime %s with %d reboots, want 200s without reboots", state.Uptime, state.Reboots)
+	}
+}
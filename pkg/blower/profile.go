@@ -0,0 +1,104 @@
+package blower
+
+import (
+	"fmt"
+)
+
+// Profile describes a single blower: how it is presented, the ranges it
+// accepts and the state it is put in when it is first seen.
+type Profile struct {
+	Name        string           `mapstructure:"name" yaml:"name,omitempty" json:"name,omitempty"`
+	Room        string           `mapstructure:"room" yaml:"room,omitempty" json:"room,omitempty"`
+	PowerSteps  int              `mapstructure:"power-steps" yaml:"power-steps" json:"power_steps"`
+	Temperature TemperatureRange `mapstructure:"temperature" yaml:"temperature" json:"temperature"`
+	Defaults    Defaults         `mapstructure:"defaults" yaml:"defaults" json:"defaults"`
+}
+
+type TemperatureRange struct {
+	Min float64 `mapstructure:"min" yaml:"min" json:"min"`
+	Max float64 `mapstructure:"max" yaml:"max" json:"max"`
+}
+
+// Defaults is the state a blower starts with. When a mode is set, it is
+// pushed to the blower on first contact instead of adopting the blower's own.
+// Seen blowers are not remembered, so the mode is pushed again on the first
+// contact after every restart.
+type Defaults struct {
+	Mode        string  `mapstructure:"mode" yaml:"mode,omitempty" json:"mode,omitempty"`
+	Power       int     `mapstructure:"power" yaml:"power" json:"power"`
+	Temperature float64 `mapstructure:"temperature" yaml:"temperature" json:"temperature"`
+}
+
+// DefaultProfile returns the profile used for blowers without any configuration.
+func DefaultProfile() Profile {
+	return Profile{
+		PowerSteps: MaxFanPower,
+		Temperature: TemperatureRange{
+			Min: MinTemperature,
+			Max: MaxTemperature,
+		},
+		Defaults: Defaults{
+			Power:       6,
+			Temperature: 25.0,
+		},
+	}
+}
+
+// Validate checks that the ranges and defaults of the profile are usable.
+func (profile Profile) Validate() error {
+	if profile.PowerSteps < 1 || profile.PowerSteps > MaxFanPower {
+		return fmt.Errorf("power steps must be between 1 and %d, recieved: %d", MaxFanPower, profile.PowerSteps)
+	}
+	if profile.Temperature.Min < MinTemperature || profile.Temperature.Max > MaxTemperature || profile.Temperature.Min > profile.Temperature.Max {
+		return fmt.Errorf("temperature range must be within %.0f and %.0f, recieved: %v-%v",
+			MinTemperature, MaxTemperature, profile.Temperature.Min, profile.Temperature.Max)
+	}
+
+	defaults := Settings{
+		FanPower:    &profile.Defaults.Power,
+		Temperature: &profile.Defaults.Temperature,
+	}
+	if profile.Defaults.Mode != "" {
+		defaults.Mode = &profile.Defaults.Mode
+	}
+	if err := profile.ValidateSettings(defaults); err != nil {
+		return fmt.Errorf("invalid defaults: %w", err)
+	}
+	return nil
+}
+
+// ValidateSettings checks every field of the settings against the profile
+// without applying them.
+func (profile Profile) ValidateSettings(settings Settings) error {
+	if settings.Mode != nil {
+		if _, err := ModeAsInt(*settings.Mode); err != nil {
+			return err
+		}
+	}
+	if settings.FanPower != nil {
+		if err := profile.validateFanPower(*settings.FanPower); err != nil {
+			return err
+		}
+	}
+	if settings.Temperature != nil {
+		if err := profile.validateTemperature(*settings.Temperature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (profile Profile) validateFanPower(power int) error {
+	if power < 0 || power > profile.PowerSteps {
+		return fmt.Errorf("fan power must be postive and less than %d, recieved: %d", profile.PowerSteps, power)
+	}
+	return nil
+}
+
+func (profile Profile) validateTemperature(temp float64) error {
+	if temp > profile.Temperature.Max || temp < profile.Temperature.Min {
+		return fmt.Errorf("temperature must be less than %v and more than %v, recieved: %f",
+			profile.Temperature.Max, profile.Temperature.Min, temp)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package blower
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProfileValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(profile *Profile)
+		wantErr bool
+	}{
+		{name: "default profile", modify: func(profile *Profile) {}},
+		{name: "default mode", modify: func(profile *Profile) { profile.Defaults.Mode = "auto" }},
+		{name: "single power step", modify: func(profile *Profile) {
+			profile.PowerSteps = 1
+			profile.Defaults.Power = 1
+		}},
+		{name: "no power steps", modify: func(profile *Profile) { profile.PowerSteps = 0 }, wantErr: true},
+		{name: "too many power steps", modify: func(profile *Profile) { profile.PowerSteps = MaxFanPower + 1 }, wantErr: true},
+		{name: "minimum below range", modify: func(profile *Profile) { profile.Temperature.Min = MinTemperature - 1 }, wantErr: true},
+		{name: "maximum above range", modify: func(profile *Profile) { profile.Temperature.Max = MaxTemperature + 1 }, wantErr: true},
+		{name: "inverted range", modify: func(profile *Profile) {
+			profile.Temperature.Min = 25
+			profile.Temperature.Max = 20
+		}, wantErr: true},
+		{name: "unknown default mode", modify: func(profile *Profile) { profile.Defaults.Mode = "turbo" }, wantErr: true},
+		{name: "default power above steps", modify: func(profile *Profile) {
+			profile.PowerSteps = 4
+			profile.Defaults.Power = 6
+		}, wantErr: true},
+		{name: "default temperature outside range", modify: func(profile *Profile) {
+			profile.Temperature.Max = 22
+			profile.Defaults.Temperature = 25
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := DefaultProfile()
+			tt.modify(&profile)
+			err := profile.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfileValidateSettings(t *testing.T) {
+	profile := DefaultProfile()
+	profile.PowerSteps = 6
+	profile.Temperature = TemperatureRange{Min: 18, Max: 24}
+
+	mode := func(m string) Settings { return Settings{Mode: &m} }
+	power := func(p int) Settings { return Settings{FanPower: &p} }
+	temperature := func(temp float64) Settings { return Settings{Temperature: &temp} }
+
+	tests := []struct {
+		name     string
+		settings Settings
+		wantErr  bool
+	}{
+		{name: "nothing", settings: Settings{}},
+		{name: "mode", settings: mode("eco")},
+		{name: "unknown mode", settings: mode("turbo"), wantErr: true},
+		{name: "power off", settings: power(0)},
+		{name: "full power", settings: power(6)},
+		{name: "power above steps", settings: power(7), wantErr: true},
+		{name: "negative power", settings: power(-1), wantErr: true},
+		{name: "temperature at the edges", settings: temperature(18)},
+		{name: "temperature below range", settings: temperature(17.5), wantErr: true},
+		{name: "temperature above range", settings: temperature(24.5), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := profile.ValidateSettings(tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSettings() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfileJSON(t *testing.T) {
+	profile := DefaultProfile()
+	profile.Name = "Living room fan"
+	profile.Defaults.Mode = "auto"
+
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"Living room fan","power_steps":12,"temperature":{"min":15,"max":30},` +
+		`"defaults":{"mode":"auto","power":6,"temperature":25}}`
+	if string(encoded) != want {
+		t.Errorf("profile encodes as %s, want %s", encoded, want)
+	}
+}
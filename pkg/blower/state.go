@@ -0,0 +1,83 @@
+package blower
+
+import "time"
+
+// Field names a part of the state of a blower.
+type Field string
+
+const (
+	FieldProfile     Field = "profile"
+	FieldMode        Field = "mode"
+	FieldRunning     Field = "running"
+	FieldFanPower    Field = "power"
+	FieldRPM         Field = "rpm"
+	FieldTemperature Field = "temperature"
+	FieldUptime      Field = "uptime"
+	FieldReboots     Field = "reboots"
+)
+
+// State is a copy of the state of a blower at one point in time.
+type State struct {
+	ID              string        `json:"id"`
+	Profile         Profile       `json:"profile"`
+	FirmwareVersion string        `json:"firmware_version"`
+	Mode            string        `json:"mode"`
+	Running         bool          `json:"running"`
+	FanPower        int           `json:"power"`
+	RPM             int           `json:"rpm"`
+	Temperature     float64       `json:"temperature"`
+	LastContact     time.Time     `json:"last_contact"`
+	Uptime          time.Duration `json:"uptime"`
+	Reboots         int           `json:"reboots"`
+	LastReboot      time.Time     `json:"last_reboot"`
+}
+
+// FanPowerPercentage returns the fan power relative to the power steps of the
+// blower.
+func (state State) FanPowerPercentage() int {
+	return state.FanPower * 100 / state.Profile.PowerSteps
+}
+
+// Change lists the fields of a blower changed by a single update, with the
+// state that resulted from it.
+type Change struct {
+	ID     string    `json:"id"`
+	Fields []Field   `json:"fields"`
+	State  State     `json:"state"`
+	Time   time.Time `json:"time"`
+}
+
+// Has reports whether the change includes the given field.
+func (change Change) Has(field Field) bool {
+	for _, f := range change.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot returns a copy of the current state of the blower.
+func (blower *Blower) Snapshot() State {
+	blower.lock.RLock()
+	defer blower.lock.RUnlock()
+	return blower.state()
+}
+
+// state must be called with the lock held.
+func (blower *Blower) state() State {
+	return State{
+		ID:              blower.id,
+		Profile:         blower.profile,
+		FirmwareVersion: blower.FirmwareVersion(),
+		Mode:            blower.mode,
+		Running:         blower.running,
+		FanPower:        blower.fanPower,
+		RPM:             blower.rpm,
+		Temperature:     blower.temperature,
+		LastContact:     blower.lastKeepAlive,
+		Uptime:          time.Duration(blower.uptime) * time.Millisecond,
+		Reboots:         blower.reboots,
+		LastReboot:      blower.lastReboot,
+	}
+}
@@ -2,14 +2,22 @@ package client
 
 import (
 	"brightpod/pkg/blower"
+	"brightpod/pkg/client/control"
 	"brightpod/pkg/client/protocol"
+	"brightpod/pkg/client/queue"
+	"brightpod/pkg/config"
+	"brightpod/pkg/mqtt"
+	"brightpod/pkg/topics"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/logrusorgru/aurora"
 	"github.com/mochi-co/hanami"
 
 	cmap "github.com/orcaman/concurrent-map"
@@ -17,117 +25,437 @@ import (
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
-var (
-	blowers = cmap.New()
-	client  *hanami.Client
-)
+// ErrUnknownBlower is returned for commands to a blower that has never been
+// seen and is not declared.
+var ErrUnknownBlower = errors.New("blower does not exist")
+
+// Options configures the connection to the mqtt server and the handling of
+// commands for blowers that are offline.
+type Options struct {
+	Username string
+	Password string
+	Server   string
+	// TLSConfig is used when the server URL has a TLS scheme such as ssl://.
+	TLSConfig *tls.Config
+	// OpenConnection opens the connection instead of dialing Server when
+	// set, e.g. to attach to the built-in server in-process.
+	OpenConnection paho.OpenConnectionFunc
+	// ClientID identifies brightpod to the server.
+	ClientID string
+	// CleanSession makes the server forget the subscriptions and queued
+	// messages of brightpod when it disconnects.
+	CleanSession bool
+	// ConnectAttempts is the number of times connecting is tried on
+	// startup, 0 tries until the context is done.
+	ConnectAttempts int
+	// MaxRetryInterval caps the exponential backoff between connection
+	// attempts, on startup and after losing the connection.
+	MaxRetryInterval time.Duration
+
+	// OfflineTimeout is the time after the last keepalive a blower is
+	// considered offline.
+	OfflineTimeout time.Duration
+	// CommandTTL is the time a command for an offline blower stays queued.
+	CommandTTL time.Duration
+	// Commands holds the commands of offline blowers. A queue with
+	// CommandTTL is used when nil.
+	Commands *queue.Queue
+	// Devices are blower IDs that accept queued commands before they have
+	// ever been seen.
+	Devices []string
+	// Inventory holds the configuration of the declared blowers, which
+	// also accept queued commands before they have been seen.
+	Inventory *config.Inventory
+	// Topics is the layout of every topic subscribed and published to.
+	Topics topics.Layout
+	// Delivery sets the QoS and the retain flag of each class of topic.
+	Delivery topics.DeliveryOptions
+	// Logger receives the log of the controller, the standard logger is
+	// used when nil.
+	Logger *log.Logger
+	// OnConnect is called once connected, e.g. to subscribe to more topics.
+	OnConnect []func(client *hanami.Client) error
+}
+
+// Controller monitors the blowers that send keepalives to the mqtt server,
+// and sends them the commands received on their control topics or through
+// Command. Controllers are independent of each other.
+type Controller struct {
+	opts     Options
+	logger   *log.Logger
+	client   *hanami.Client
+	socket   *subscriptionSocket
+	blowers  cmap.ConcurrentMap
+	commands *queue.Queue
+	layout   topics.Layout
+	delivery topics.DeliveryOptions
+
+	// inventoryLock guards the inventory and the declared blower IDs, which
+	// are replaced when the configuration is reloaded.
+	inventoryLock sync.RWMutex
+	declared      map[string]bool
+	paired        map[string]bool
+	inventory     *config.Inventory
 
-func Start(clientUsername, clientPassword, mqttServer string) {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// availability holds the last availability published for each blower.
+	availability cmap.ConcurrentMap
+
+	connectionStateLock sync.Mutex
+	connectionState     ConnectionState
+
+	// connectionsLock guards the sessions the embedded broker reported for
+	// each username and the recent connection events.
+	connectionsLock sync.Mutex
+	sessions        map[string]int
+	history         []mqtt.ConnectionEvent
+
+	handlersLock sync.Mutex
+	handlers     map[int]func(Event)
+	nextHandler  int
+
+	// stopping is set once the controller shuts down.
+	stopping int32
+}
+
+// New returns a controller for the given options. It does not connect until
+// Run is called. The topics default to topics.DefaultLayout, and the retry
+// interval to a minute.
+func New(opts Options) *Controller {
+	if opts.Topics == (topics.Layout{}) {
+		opts.Topics = topics.DefaultLayout()
+	}
+	if opts.MaxRetryInterval <= 0 {
+		opts.MaxRetryInterval = time.Minute
+	}
+	c := &Controller{
+		opts:         opts,
+		logger:       opts.Logger,
+		blowers:      cmap.New(),
+		commands:     opts.Commands,
+		layout:       opts.Topics,
+		delivery:     opts.Delivery,
+		paired:       map[string]bool{},
+		availability: cmap.New(),
+		sessions:     map[string]int{},
+		handlers:     map[int]func(Event){},
+	}
+	if c.logger == nil {
+		c.logger = log.Default()
+	}
+	if c.commands == nil {
+		c.commands = queue.New(opts.CommandTTL)
+	}
+	inventory := opts.Inventory
+	if inventory == nil {
+		inventory = &config.Inventory{
+			Devices: map[string]config.Device{},
+		}
+	}
+	c.setInventory(inventory, opts.Devices)
 
 	options := paho.NewClientOptions()
-	options.Username = clientUsername
-	options.Password = clientPassword
+	options.Username = opts.Username
+	options.Password = opts.Password
+	if opts.TLSConfig != nil {
+		options.SetTLSConfig(opts.TLSConfig)
+	}
+	options.SetCustomOpenConnectionFn(opts.OpenConnection)
+	c.setReconnect(options)
 
-	client = hanami.New(mqttServer, options)
+	c.client = hanami.New(opts.Server, options)
+	c.socket = newSubscriptionSocket(c.client.Socket)
+	c.client.Socket = c.socket
+	return c
+}
 
-	err := client.Connect()
-	if err != nil {
-		log.Fatal(err)
+// Run connects to the mqtt server and handles the blowers until the context
+// is done, then shuts down in order. It returns an error when it cannot
+// connect or subscribe. A lost connection is retried in the background. A
+// controller runs only once.
+func (c *Controller) Run(ctx context.Context) error {
+	if err := c.connect(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("could not connect to the mqtt server: %w", err)
 	}
+	defer c.client.Socket.Disconnect(250)
 
-	err = client.Subscribe("keepalives", "+/keep_alive", 0, false, handleKeepAlive)
+	err := c.client.Subscribe("keepalives", c.layout.KeepAliveFilter(), c.delivery.KeepAlive.QoS, false, c.handleKeepAlive)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("could not subscribe to keepalives: %w", err)
 	}
 
-	err = client.Subscribe("control", "control/+/+", 0, false, handleControl)
+	err = c.client.Subscribe("control", c.layout.ControlFilter(), c.delivery.Control.QoS, false, c.handleControl)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("could not subscribe to control topics: %w", err)
 	}
 
-	<-sigs
-	client.UnsubscribeAll("keepalives", false)
-	client.UnsubscribeAll("control", false)
-	log.Println(aurora.BgGreen("Finished"))
+	for _, onConnect := range c.opts.OnConnect {
+		if err := onConnect(c.client); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	if c.opts.OfflineTimeout > 0 {
+		go c.monitorAvailability(c.opts.OfflineTimeout/4, done)
+	}
+
+	<-ctx.Done()
+	close(done)
+	c.shutdown()
+	return nil
+}
+
+// shutdown stops taking commands, publishes the last state of every blower
+// and marks them offline, then unsubscribes. The client disconnects once
+// Run returns.
+func (c *Controller) shutdown() {
+	c.logger.Printf("Shutting down, no longer taking commands")
+	c.client.UnsubscribeAll("control", false)
+	atomic.StoreInt32(&c.stopping, 1)
+
+	// Without a connection nothing can be published, and the mqtt server
+	// already sent the last will.
+	if c.client.Socket.IsConnectionOpen() {
+		for _, blwr := range c.Blowers() {
+			c.publishBlowerState(blwr)
+			c.publishAvailability(blwr.ID(), false)
+		}
+		// A clean disconnect does not send the last will.
+		c.publishServiceAvailability(false)
+	}
+
+	// Every subscription, including the ones of OnConnect.
+	c.client.UnsubscribeAll("", true)
 }
 
-func handleKeepAlive(in *hanami.Payload) {
+// isStopping reports whether the controller is shutting down, after which
+// blowers are no longer reported online.
+func (c *Controller) isStopping() bool {
+	return atomic.LoadInt32(&c.stopping) == 1
+}
+
+// Blowers returns every monitored blower, ordered by ID.
+func (c *Controller) Blowers() []*blower.Blower {
+	blowers := make([]*blower.Blower, 0, c.blowers.Count())
+	for item := range c.blowers.IterBuffered() {
+		blowers = append(blowers, item.Val.(*blower.Blower))
+	}
+	sort.Slice(blowers, func(i, j int) bool {
+		return blowers[i].ID() < blowers[j].ID()
+	})
+	return blowers
+}
+
+// States returns a snapshot of every monitored blower, ordered by ID.
+func (c *Controller) States() []blower.State {
+	blowers := c.Blowers()
+	states := make([]blower.State, len(blowers))
+	for i, blwr := range blowers {
+		states[i] = blwr.Snapshot()
+	}
+	return states
+}
+
+// Blower returns the monitored blower with the given ID.
+func (c *Controller) Blower(id string) (*blower.Blower, bool) {
+	obj, ok := c.blowers.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return obj.(*blower.Blower), true
+}
+
+func (c *Controller) handleKeepAlive(in *hanami.Payload) {
 	var blwr *blower.Blower
+	isNew := false
 
-	username := in.Elements[0]
+	username, ok := c.layout.MatchKeepAlive(in.Topic)
+	if !ok {
+		c.logger.Printf("Could not find the blower ID in keepalive topic: %s", in.Topic)
+		return
+	}
 	kaMsg, err := protocol.ParseKeepAlive(in.Msg)
 	if err != nil {
-		log.Printf("Could not parse keepalive: %s", err.Error())
+		c.logger.Printf("Could not parse keepalive: %s", err.Error())
 		return
 	}
 
-	if blowerFromMap, ok := blowers.Get(username); ok {
-		blwr = blowerFromMap.(*blower.Blower)
-	} else {
-		blwr, err = blower.New(username, 6, 25.0, 6000, kaMsg.V, kaMsg.RV, kaMsg.FS)
+	blwr, ok = c.Blower(username)
+	if !ok {
+		created, err := blower.New(username, c.currentInventory().Profile(username), blower.MaxRPM, kaMsg.V, kaMsg.RV, kaMsg.FS)
 		if err != nil {
-			log.Printf("Could not create new blower: %s", err)
+			c.logger.Printf("Could not create new blower: %s", err)
 			return
 		}
-		log.Printf("Blower with ID %s is now monitored.", username)
+		created.SetChangeHandler(c.handleChange)
+		// Keepalives of the same blower may be handled at once, only the
+		// first one stores its blower and every other uses that one.
+		if c.blowers.SetIfAbsent(username, created) {
+			// Announce the blower even if its keepalive is rejected below,
+			// as it is stored from now on and never new again.
+			isNew = true
+			c.logger.Printf("Blower with ID %s is now monitored.", username)
+			c.emit(Event{Type: EventMonitored, ID: username})
+			c.publishDiscovery(created, false)
+		}
+		blwr, _ = c.Blower(username)
 	}
-	if err := blwr.SetModeFromInt(kaMsg.M); err != nil {
-		log.Printf("Could not set mode to: %s", err.Error())
+
+	// A rebooted blower reports its own defaults, so keep the mode we last
+	// sent it instead and push it back below. The same goes for a new blower
+	// with a default mode configured.
+	keepAlive := blower.KeepAlive{
+		Running:   kaMsg.S == 1,
+		Extended:  kaMsg.Extended,
+		Uptime:    kaMsg.MS,
+		DiffStart: kaMsg.DiffStart,
+		DiffStop:  kaMsg.DiffStop,
+	}
+	if !isNew || blwr.Profile().Defaults.Mode == "" {
+		keepAlive.Mode = &kaMsg.M
+	}
+	previous := blwr.Snapshot()
+	rebooted, err := blwr.ReportKeepAlive(keepAlive)
+	if err != nil {
+		c.logger.Printf("Could not set mode to: %s", err.Error())
 		return
 	}
+	if rebooted {
+		c.logger.Printf("Blower %s rebooted, uptime went from %s to %s", username, previous.Uptime, blwr.Uptime())
+		c.publishRebootEvent(blwr, previous.Uptime)
+	}
+	pushState := rebooted || keepAlive.Mode == nil
+	c.logger.Printf("Blower data: %+v", blwr.Snapshot())
 
-	blwr.IsFanRunning = kaMsg.S == 1
+	if delivered := c.deliverQueuedCommands(blwr); pushState && !delivered {
+		if err := c.publishBlowerStatus(blwr); err != nil {
+			c.logger.Printf("Could not send the state to blower %s: %s", blwr.ID(), err)
+		}
+	}
+	c.publishBlowerState(blwr)
+	c.publishAvailability(blwr.ID(), c.isOnline(blwr))
+}
 
-	// Refresh last seen time
-	blwr.UpdateLastContact()
+// deliverQueuedCommands applies the commands queued while the blower was
+// offline and sends the result as a single status update. It reports whether
+// a status update was sent. Commands that could not be sent stay queued.
+func (c *Controller) deliverQueuedCommands(blwr *blower.Blower) bool {
+	pending := c.commands.Pop(blwr.ID())
+	if len(pending) == 0 {
+		return false
+	}
 
-	// Persist the new blower data
-	blowers.Set(username, blwr)
-	log.Printf("Blower data: %+v", blwr)
+	for _, cmd := range pending {
+		if err := blwr.Apply(cmd.Settings); err != nil {
+			c.logger.Printf("Could not apply the queued %s command to blower %s: %s", cmd.Command, blwr.ID(), err)
+		}
+	}
+	if err := c.publishBlowerStatus(blwr); err != nil {
+		c.commands.Requeue(blwr.ID(), pending)
+		c.logger.Printf("Could not deliver %d queued commands to blower %s, keeping them queued: %s", len(pending), blwr.ID(), err)
+		return false
+	}
+	c.logger.Printf("Delivered %d queued commands to blower %s", len(pending), blwr.ID())
+	for _, cmd := range pending {
+		c.emit(Event{Type: EventCommandSent, ID: blwr.ID(), Command: cmd.Command})
+	}
+	return true
 }
 
-func publishBlowerStatus(client *hanami.Client, blwr *blower.Blower) {
-	topic := fmt.Sprintf("%s/status", blwr.ID())
-	// topic := ""
-	payload := blwr.GenerateStausPayload()
-	client.Publish(topic, 0, false, payload)
+// PendingCommands returns the queued commands of every offline blower.
+func (c *Controller) PendingCommands() map[string][]queue.Command {
+	return c.commands.All()
 }
 
-func handleControl(in *hanami.Payload) {
-	blowerID := in.Elements[0]
-	command := in.Elements[1]
-	value := in.Msg["v"]
+// publishBlowerStatus sends the settings of a blower to it.
+func (c *Controller) publishBlowerStatus(blwr *blower.Blower) error {
+	return publish(c.client, c.layout.StatusTopic(blwr.ID()), c.delivery.Status, blwr.GenerateStausPayload())
+}
+
+// publishRebootEvent notifies listeners that a blower rebooted.
+func (c *Controller) publishRebootEvent(blwr *blower.Blower, previousUptime time.Duration) {
+	c.emit(Event{Type: EventReboot, ID: blwr.ID()})
+
+	topic := c.layout.EventTopic(blwr.ID(), "reboot")
+	payload := hanami.Msg{
+		"id":              blwr.ID(),
+		"time":            time.Now().Format(time.RFC3339),
+		"uptime":          blwr.Uptime().Milliseconds(),
+		"previous_uptime": previousUptime.Milliseconds(),
+		"reboots":         blwr.Reboots(),
+	}
+	if err := publish(c.client, topic, topics.Delivery{}, payload); err != nil {
+		c.logger.Printf("Could not publish reboot event for blower %s: %s", blwr.ID(), err)
+	}
+}
 
-	obj, ok := blowers.Get(blowerID)
+func (c *Controller) handleControl(in *hanami.Payload) {
+	blowerID, command, ok := c.layout.MatchControl(in.Topic)
 	if !ok {
-		log.Printf("Blower with ID does not exist: %s", blowerID)
+		c.logger.Printf("Could not find the blower ID and command in control topic: %s", in.Topic)
 		return
 	}
 
-	blwr := obj.(*blower.Blower)
+	if in.Error != nil {
+		c.logger.Printf("Could not parse the %s command payload: %s", command, in.Error)
+		return
+	}
 
-	if command == "mode" {
-		blwr.SetModeFromString(value.(string))
-		publishBlowerStatus(client, blwr)
-	} else if command == "power" {
-		powerValuePercentage, ok := value.(float64)
-		if !ok {
-			log.Printf("Could not parse the power value: %s", value)
-		}
-		powerValue := 12 * (int(powerValuePercentage) / 100)
-		blwr.SetFanPower(powerValue)
-		publishBlowerStatus(client, blwr)
-	} else if command == "max_rpm" {
-		// rpmValue, ok := value.(float64)
-		// if !ok {
-		// 	log.Printf("Could not parse the power value: %s", value)
-		// }
-		// blwr.SetFanRPM(int(rpmValue))
-		publishBlowerStatus(client, blwr)
-	} else {
-		log.Printf("Unknown control commmand: %s", command)
+	settings, err := control.Parse(command, in.Msg, c.profile(blowerID).PowerSteps)
+	if err != nil {
+		c.logger.Printf("Could not parse the %s command: %s", command, err)
 		return
 	}
+
+	if _, err := c.Command(blowerID, command, *settings); err != nil {
+		c.logger.Printf("Could not handle the %s command for blower %s: %s", command, blowerID, err)
+	}
+}
+
+// profile returns the profile of a blower, the one it is monitored with
+// when it has been seen.
+func (c *Controller) profile(id string) blower.Profile {
+	if blwr, ok := c.Blower(id); ok {
+		return blwr.Profile()
+	}
+	return c.currentInventory().Profile(id)
+}
+
+// Command applies settings to a blower and sends them to it. While the
+// blower is offline, or when they cannot be sent, the settings are queued
+// until it comes back. It reports whether the command was queued.
+func (c *Controller) Command(id, command string, settings blower.Settings) (bool, error) {
+	if c.isStopping() {
+		return false, fmt.Errorf("the controller is shutting down")
+	}
+
+	blwr, ok := c.Blower(id)
+	if !ok || !c.isOnline(blwr) {
+		if !ok && !c.isDeclared(id) {
+			return false, ErrUnknownBlower
+		}
+		if err := c.profile(id).ValidateSettings(settings); err != nil {
+			return false, err
+		}
+		queued := c.commands.Push(id, command, settings)
+		c.logger.Printf("Blower %s is offline, queued the %s command until %s", id, command, queued.Expires.Format(time.RFC3339))
+		c.emit(Event{Type: EventCommandQueued, ID: id, Command: command})
+		return true, nil
+	}
+
+	if err := blwr.Apply(settings); err != nil {
+		return false, err
+	}
+	defer c.publishBlowerState(blwr)
+	if err := c.publishBlowerStatus(blwr); err != nil {
+		queued := c.commands.Push(id, command, settings)
+		c.logger.Printf("Could not send the %s command to blower %s, queued it until %s: %s", command, id, queued.Expires.Format(time.RFC3339), err)
+		c.emit(Event{Type: EventCommandQueued, ID: id, Command: command})
+		return true, nil
+	}
+	c.emit(Event{Type: EventCommandSent, ID: id, Command: command})
+	return false, nil
 }
@@ -0,0 +1,409 @@
+package client
+
+import (
+	"brightpod/pkg/blower"
+	"brightpod/pkg/config"
+	"brightpod/pkg/homeassistant"
+	"brightpod/pkg/mqtt"
+	"brightpod/pkg/topics"
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-co/hanami"
+)
+
+// waitTimeout bounds the wait for a message or an event in the tests.
+const waitTimeout = 2 * time.Second
+
+type message struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+// recorder collects the messages of a watching client and the events of a
+// controller.
+type recorder struct {
+	lock     sync.Mutex
+	messages []message
+	events   []Event
+}
+
+func (r *recorder) addMessage(msg message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages = append(r.messages, msg)
+}
+
+func (r *recorder) addEvent(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+// on returns the payloads received on a topic so far.
+func (r *recorder) on(topic string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	payloads := []string{}
+	for _, msg := range r.messages {
+		if msg.topic == topic {
+			payloads = append(payloads, msg.payload)
+		}
+	}
+	return payloads
+}
+
+// waitForPrefix waits until a message was received on a topic starting with
+// the prefix.
+func (r *recorder) waitForPrefix(t *testing.T, prefix string) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		r.lock.Lock()
+		for _, msg := range r.messages {
+			if strings.HasPrefix(msg.topic, prefix) {
+				r.lock.Unlock()
+				return
+			}
+		}
+		r.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("received no message on %s", prefix)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitFor waits until count messages were received on a topic and returns
+// their payloads.
+func (r *recorder) waitFor(t *testing.T, topic string, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		payloads := r.on(topic)
+		if len(payloads) >= count {
+			return payloads
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d messages on %s, want %d", len(payloads), topic, count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// eventTypes returns the types of the events of a blower so far, other than
+// changes.
+func (r *recorder) eventTypes(id string) []EventType {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	types := []EventType{}
+	for _, event := range r.events {
+		if event.ID == id && event.Type != EventChanged {
+			types = append(types, event.Type)
+		}
+	}
+	return types
+}
+
+// startBroker starts a built-in server without network listeners, where the
+// clients opened with its OpenConnection have full access.
+func startBroker(t *testing.T) *mqtt.Server {
+	server := mqtt.New(nil)
+	server.SetController(mqtt.DefaultController)
+	server.SetACL(map[string]mqtt.Rule{}, func(username string) mqtt.Rule {
+		return mqtt.FullAccess()
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestController connects a controller to the server without running
+// it, so that the tests can hand it keepalives and commands directly. Its
+// events are recorded.
+func newTestController(t *testing.T, server *mqtt.Server, opts Options, events *recorder) *Controller {
+	opts.Server = mqtt.InProcessAddress
+	opts.Username = mqtt.DefaultController
+	opts.OpenConnection = server.OpenConnection
+	opts.ClientID = "brightpod-test"
+	opts.CleanSession = true
+	opts.ConnectAttempts = 1
+	if opts.Delivery == (topics.DeliveryOptions{}) {
+		opts.Delivery = topics.DefaultDeliveryOptions()
+	}
+	if opts.OfflineTimeout == 0 {
+		opts.OfflineTimeout = time.Minute
+	}
+	if opts.CommandTTL == 0 {
+		opts.CommandTTL = time.Minute
+	}
+	opts.Logger = log.New(ioutil.Discard, "", 0)
+
+	c := New(opts)
+	if events != nil {
+		c.Subscribe(events.addEvent)
+	}
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.client.Socket.Disconnect(0)
+	})
+	return c
+}
+
+// watch subscribes a client of the server to the filter and records what it
+// receives.
+func watch(t *testing.T, server *mqtt.Server, filter string) *recorder {
+	options := paho.NewClientOptions()
+	options.AddBroker(mqtt.InProcessAddress)
+	options.SetClientID("watcher-" + strings.NewReplacer("/", "-", "#", "all", "+", "any").Replace(filter))
+	options.SetCustomOpenConnectionFn(server.OpenConnection)
+	client := paho.NewClient(options)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() {
+		client.Disconnect(0)
+	})
+
+	r := &recorder{}
+	token := client.Subscribe(filter, 1, func(_ paho.Client, msg paho.Message) {
+		r.addMessage(message{topic: msg.Topic(), payload: string(msg.Payload()), retained: msg.Retained()})
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return r
+}
+
+// keepAlive returns a keepalive of the blower in the given mode, with its
+// uptime in milliseconds.
+func keepAlive(id string, mode int, uptime int64) *hanami.Payload {
+	return &hanami.Payload{
+		Topic: topics.DefaultLayout().KeepAliveTopic(id),
+		Msg: hanami.Msg{
+			"v": 1.0, "rv": 2.0, "fs": 0.0,
+			"m": float64(mode), "s": 1.0,
+			"ms": float64(uptime),
+		},
+	}
+}
+
+func TestRebootKeepsTheModeAndPushesStatus(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{}, events)
+
+	c.handleKeepAlive(keepAlive("fan1", 1, 5000))
+	messages.waitFor(t, "state/fan1", 1)
+	if status := messages.on("fan1/status"); len(status) != 0 {
+		t.Fatalf("status sent to a blower running in its own mode: %v", status)
+	}
+
+	// The rebooted blower reports its default mode, eco.
+	c.handleKeepAlive(keepAlive("fan1", 0, 100))
+	status := messages.waitFor(t, "fan1/status", 1)
+	if !strings.HasSuffix(status[0], " 1") {
+		t.Errorf("status = %q, want the mode on from before the reboot", status[0])
+	}
+	if blwr, _ := c.Blower("fan1"); blwr.Mode() != "on" {
+		t.Errorf("mode = %s after the reboot, want on", blwr.Mode())
+	}
+	reboot := messages.waitFor(t, "events/fan1/reboot", 1)
+	if !strings.Contains(reboot[0], `"previous_uptime":5000`) || !strings.Contains(reboot[0], `"reboots":1`) {
+		t.Errorf("reboot event = %s", reboot[0])
+	}
+	if types := events.eventTypes("fan1"); countEvents(types, EventReboot) != 1 {
+		t.Errorf("events = %v, want a reboot", types)
+	}
+}
+
+func countEvents(types []EventType, want EventType) int {
+	count := 0
+	for _, eventType := range types {
+		if eventType == want {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRejectedFirstKeepAliveAnnouncesBlower(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	inventory := &config.Inventory{
+		Devices:       map[string]config.Device{},
+		HomeAssistant: homeassistant.Options{Enabled: true},
+	}
+	c := newTestController(t, server, Options{Inventory: inventory}, events)
+
+	// Mode 7 is unknown, so the keepalive is rejected once the blower is
+	// stored.
+	c.handleKeepAlive(keepAlive("fan1", 7, 5000))
+	if _, ok := c.Blower("fan1"); !ok {
+		t.Fatalf("the blower was not stored")
+	}
+	if types := events.eventTypes("fan1"); len(types) != 1 || types[0] != EventMonitored {
+		t.Errorf("events = %v, want the blower monitored", types)
+	}
+	messages.waitForPrefix(t, homeassistant.DefaultDiscoveryPrefix+"/")
+
+	c.handleKeepAlive(keepAlive("fan1", 1, 6000))
+	if types := events.eventTypes("fan1"); countEvents(types, EventMonitored) != 1 {
+		t.Errorf("events = %v, want the blower announced once", types)
+	}
+}
+
+func TestFirstKeepAliveAnnouncesAndPublishes(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{}, events)
+
+	c.handleKeepAlive(keepAlive("fan1", 3, 5000))
+	if types := events.eventTypes("fan1"); len(types) != 2 || types[0] != EventMonitored || types[1] != EventOnline {
+		t.Errorf("events = %v, want monitored then online", types)
+	}
+	state := messages.waitFor(t, "state/fan1", 1)
+	if !strings.Contains(state[0], `"mode":"auto"`) {
+		t.Errorf("state = %s, want the reported mode auto", state[0])
+	}
+	if availability := messages.waitFor(t, "state/fan1/availability", 1); availability[0] != "online" {
+		t.Errorf("availability = %s, want online", availability[0])
+	}
+	// The availability is retained for clients subscribing later.
+	late := watch(t, server, "state/fan1/availability")
+	if availability := late.waitFor(t, "state/fan1/availability", 1); availability[0] != "online" {
+		t.Errorf("retained availability = %s, want online", availability[0])
+	}
+
+	// Further keepalives neither announce the blower again nor repeat its
+	// availability.
+	c.handleKeepAlive(keepAlive("fan1", 3, 6000))
+	messages.waitFor(t, "state/fan1", 2)
+	if types := events.eventTypes("fan1"); len(types) != 2 {
+		t.Errorf("events = %v after a second keepalive, want no new ones", types)
+	}
+	if availability := messages.on("state/fan1/availability"); len(availability) != 1 {
+		t.Errorf("availability published %d times, want once", len(availability))
+	}
+}
+
+func TestHandleKeepAliveIgnoresInvalidMessages(t *testing.T) {
+	server := startBroker(t)
+	c := newTestController(t, server, Options{}, nil)
+
+	c.handleKeepAlive(&hanami.Payload{Topic: "fan1/other", Msg: keepAlive("fan1", 1, 0).Msg})
+	c.handleKeepAlive(&hanami.Payload{Topic: "fan1/keep_alive", Msg: hanami.Msg{"v": 1.0}})
+	if blowers := c.Blowers(); len(blowers) != 0 {
+		t.Errorf("blowers = %d, want none from invalid keepalives", len(blowers))
+	}
+}
+
+func TestHandleControlSendsStatus(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{}, events)
+	c.handleKeepAlive(keepAlive("fan1", 1, 5000))
+
+	c.handleControl(&hanami.Payload{Topic: "control/fan1/mode", Msg: hanami.Msg{"v": "eco"}})
+	status := messages.waitFor(t, "fan1/status", 1)
+	if !strings.HasSuffix(status[0], " 0") {
+		t.Errorf("status = %q, want the mode eco", status[0])
+	}
+	if blwr, _ := c.Blower("fan1"); blwr.Mode() != "eco" {
+		t.Errorf("mode = %s, want eco", blwr.Mode())
+	}
+	if types := events.eventTypes("fan1"); countEvents(types, EventCommandSent) != 1 {
+		t.Errorf("events = %v, want the command sent", types)
+	}
+
+	// Invalid commands leave the blower alone.
+	c.handleControl(&hanami.Payload{Topic: "control/fan1/mode", Msg: hanami.Msg{"v": "turbo"}})
+	c.handleControl(&hanami.Payload{Topic: "control/fan1/speed", Msg: hanami.Msg{"v": 1.0}})
+	c.handleControl(&hanami.Payload{Topic: "control/fan1", Msg: hanami.Msg{"v": "on"}})
+	if blwr, _ := c.Blower("fan1"); blwr.Mode() != "eco" {
+		t.Errorf("mode = %s after invalid commands, want eco", blwr.Mode())
+	}
+	if status := messages.on("fan1/status"); len(status) != 1 {
+		t.Errorf("status sent %d times, want once", len(status))
+	}
+}
+
+func TestCommandUnknownBlower(t *testing.T) {
+	server := startBroker(t)
+	c := newTestController(t, server, Options{}, nil)
+
+	mode := "eco"
+	if _, err := c.Command("fan1", "mode", blower.Settings{Mode: &mode}); err != ErrUnknownBlower {
+		t.Errorf("error = %v, want %v", err, ErrUnknownBlower)
+	}
+	if pending := c.PendingCommands(); len(pending) != 0 {
+		t.Errorf("pending = %v, want nothing queued", pending)
+	}
+}
+
+func TestCommandQueuedUntilKeepAlive(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{Devices: []string{"fan1"}}, events)
+
+	mode, power := "eco", 3
+	if queued, err := c.Command("fan1", "mode", blower.Settings{Mode: &mode}); err != nil || !queued {
+		t.Fatalf("Command() = %v, %v, want the command queued", queued, err)
+	}
+	if queued, err := c.Command("fan1", "power", blower.Settings{FanPower: &power}); err != nil || !queued {
+		t.Fatalf("Command() = %v, %v, want the command queued", queued, err)
+	}
+	invalid := "turbo"
+	if _, err := c.Command("fan1", "mode", blower.Settings{Mode: &invalid}); err == nil {
+		t.Errorf("an invalid mode was queued")
+	}
+	if pending := c.PendingCommands()["fan1"]; len(pending) != 2 || pending[0].Command != "mode" || pending[1].Command != "power" {
+		t.Errorf("pending = %+v, want the mode and power commands", pending)
+	}
+
+	// Both commands go out as a single status once the blower shows up.
+	c.handleKeepAlive(keepAlive("fan1", 1, 5000))
+	status := messages.waitFor(t, "fan1/status", 1)
+	if fields := strings.Fields(status[0]); len(fields) != 5 || fields[1] != "3" || fields[4] != "0" {
+		t.Errorf("status = %q, want power 3 in mode eco", status[0])
+	}
+	if pending := c.PendingCommands(); len(pending) != 0 {
+		t.Errorf("pending = %v after delivery, want nothing", pending)
+	}
+	want := []EventType{EventCommandQueued, EventCommandQueued, EventMonitored, EventCommandSent, EventCommandSent, EventOnline}
+	if types := events.eventTypes("fan1"); !equalEvents(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if status := messages.on("fan1/status"); len(status) != 1 {
+		t.Errorf("status sent %d times, want once", len(status))
+	}
+}
+
+func equalEvents(types, want []EventType) bool {
+	if len(types) != len(want) {
+		return false
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"brightpod/pkg/blower"
+	"brightpod/pkg/mqtt"
+	"brightpod/pkg/topics"
+	"time"
+
+	"github.com/mochi-co/hanami"
+)
+
+// connectionHistorySize is the number of connection events kept for the API.
+const connectionHistorySize = 100
+
+// Connections describes the sessions open on the embedded broker.
+type Connections struct {
+	Sessions map[string]int         `json:"sessions"`
+	History  []mqtt.ConnectionEvent `json:"history"`
+}
+
+// HandleConnectionEvent records a connection event of the embedded broker.
+// A blower goes online as soon as its first session opens and offline once
+// its last session ends, without waiting for keepalives.
+func (c *Controller) HandleConnectionEvent(event mqtt.ConnectionEvent) {
+	c.connectionsLock.Lock()
+	if len(c.history) == connectionHistorySize {
+		c.history = c.history[1:]
+	}
+	c.history = append(c.history, event)
+	count := c.sessions[event.Username]
+	if event.Connected {
+		count++
+	} else if count > 0 {
+		count--
+	}
+	c.sessions[event.Username] = count
+	c.connectionsLock.Unlock()
+
+	if event.Connected {
+		c.logger.Printf("Client %s connected as %s from %s", event.ClientID, event.Username, event.RemoteAddr)
+	} else {
+		c.logger.Printf("Client %s of %s disconnected: %s", event.ClientID, event.Username, event.Reason)
+	}
+
+	changed := (event.Connected && count == 1) || (!event.Connected && count == 0)
+	if !changed || c.isStopping() {
+		return
+	}
+	blwr, ok := c.Blower(event.Username)
+	if !ok {
+		return
+	}
+	if event.Connected {
+		blwr.UpdateLastContact()
+	}
+	c.publishAvailability(blwr.ID(), c.isOnline(blwr))
+	c.publishConnectionEvent(blwr, event)
+}
+
+// ConnectionHistory returns the open sessions and the recent connection
+// events of the embedded broker, oldest first.
+func (c *Controller) ConnectionHistory() Connections {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+
+	connections := Connections{
+		Sessions: map[string]int{},
+		History:  make([]mqtt.ConnectionEvent, len(c.history)),
+	}
+	for username, count := range c.sessions {
+		if count > 0 {
+			connections.Sessions[username] = count
+		}
+	}
+	copy(connections.History, c.history)
+	return connections
+}
+
+// brokerConnected reports whether the embedded broker has a session open for
+// the blower. Known is false without connection events, e.g. when brightpod
+// uses an external broker.
+func (c *Controller) brokerConnected(id string) (connected, known bool) {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+	count, known := c.sessions[id]
+	return count > 0, known
+}
+
+// isOnline reports whether the blower sent a keepalive recently and, when
+// the embedded broker reports on it, whether it is still connected.
+func (c *Controller) isOnline(blwr *blower.Blower) bool {
+	if connected, known := c.brokerConnected(blwr.ID()); known && !connected {
+		return false
+	}
+	return blwr.IsOnline(c.opts.OfflineTimeout)
+}
+
+// publishConnectionEvent notifies listeners that a blower connected to or
+// disconnected from the embedded broker.
+func (c *Controller) publishConnectionEvent(blwr *blower.Blower, event mqtt.ConnectionEvent) {
+	name, eventType := "disconnected", EventDisconnected
+	if event.Connected {
+		name, eventType = "connected", EventConnected
+	}
+	c.emit(Event{Type: eventType, ID: blwr.ID(), Time: event.Time})
+
+	payload := hanami.Msg{
+		"id":          blwr.ID(),
+		"time":        event.Time.Format(time.RFC3339),
+		"client_id":   event.ClientID,
+		"remote_addr": event.RemoteAddr,
+		"listener":    event.Listener,
+	}
+	if event.Reason != "" {
+		payload["reason"] = event.Reason
+	}
+	if err := publish(c.client, c.layout.EventTopic(blwr.ID(), name), topics.Delivery{}, payload); err != nil {
+		c.logger.Printf("Could not publish %s event for blower %s: %s", name, blwr.ID(), err)
+	}
+}
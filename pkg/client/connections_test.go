@@ -0,0 +1,104 @@
+package client
+
+import (
+	"brightpod/pkg/blower"
+	"brightpod/pkg/mqtt"
+	"strings"
+	"testing"
+)
+
+func connectionEvent(clientID string, connected bool) mqtt.ConnectionEvent {
+	event := mqtt.ConnectionEvent{Connected: connected, ClientID: clientID, Username: "fan1", Listener: "tcp"}
+	if !connected {
+		event.Reason = "closed"
+	}
+	return event
+}
+
+func TestHandleConnectionEventAvailability(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{}, events)
+	c.handleKeepAlive(keepAlive("fan1", 1, 5000))
+
+	// Only the first session and the end of the last one count.
+	c.HandleConnectionEvent(connectionEvent("a", true))
+	c.HandleConnectionEvent(connectionEvent("b", true))
+	c.HandleConnectionEvent(connectionEvent("a", false))
+	want := []EventType{EventMonitored, EventOnline, EventConnected}
+	if types := events.eventTypes("fan1"); !equalEvents(types, want) {
+		t.Errorf("events = %v with a session left, want %v", types, want)
+	}
+	messages.waitFor(t, "events/fan1/connected", 1)
+
+	c.HandleConnectionEvent(connectionEvent("b", false))
+	want = append(want, EventOffline, EventDisconnected)
+	if types := events.eventTypes("fan1"); !equalEvents(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	availability := messages.waitFor(t, "state/fan1/availability", 2)
+	if availability[1] != "offline" {
+		t.Errorf("availability = %v, want offline once the last session ended", availability)
+	}
+	disconnected := messages.waitFor(t, "events/fan1/disconnected", 1)
+	if !strings.Contains(disconnected[0], `"client_id":"b"`) || !strings.Contains(disconnected[0], `"reason":"closed"`) {
+		t.Errorf("disconnected event = %s", disconnected[0])
+	}
+
+	// A keepalive sent before the session ended does not bring it back.
+	c.handleKeepAlive(keepAlive("fan1", 1, 6000))
+	if blwr, _ := c.Blower("fan1"); c.isOnline(blwr) {
+		t.Errorf("blower online without a session")
+	}
+
+	connections := c.ConnectionHistory()
+	if len(connections.Sessions) != 0 || len(connections.History) != 4 {
+		t.Errorf("connections = %+v, want 4 events and no session", connections)
+	}
+}
+
+func TestQueuedCommandsDeliveredOnReconnect(t *testing.T) {
+	server := startBroker(t)
+	messages := watch(t, server, "#")
+	events := &recorder{}
+	c := newTestController(t, server, Options{}, events)
+	c.HandleConnectionEvent(connectionEvent("a", true))
+	c.handleKeepAlive(keepAlive("fan1", 1, 5000))
+	c.HandleConnectionEvent(connectionEvent("a", false))
+
+	mode := "eco"
+	if queued, err := c.Command("fan1", "mode", blower.Settings{Mode: &mode}); err != nil || !queued {
+		t.Fatalf("Command() = %v, %v, want the command queued while offline", queued, err)
+	}
+	if status := messages.on("fan1/status"); len(status) != 0 {
+		t.Errorf("status sent to an offline blower: %v", status)
+	}
+
+	// The blower comes back online with its session, and gets the command
+	// with its next keepalive.
+	c.HandleConnectionEvent(connectionEvent("b", true))
+	if pending := c.PendingCommands()["fan1"]; len(pending) != 1 {
+		t.Errorf("pending = %+v before a keepalive, want the command", pending)
+	}
+	c.handleKeepAlive(keepAlive("fan1", 1, 6000))
+	status := messages.waitFor(t, "fan1/status", 1)
+	if !strings.HasSuffix(status[0], " 0") {
+		t.Errorf("status = %q, want the queued mode eco", status[0])
+	}
+	if pending := c.PendingCommands(); len(pending) != 0 {
+		t.Errorf("pending = %v after delivery, want nothing", pending)
+	}
+
+	want := []EventType{
+		EventMonitored, EventOnline, EventOffline, EventDisconnected,
+		EventCommandQueued, EventOnline, EventConnected, EventCommandSent,
+	}
+	if types := events.eventTypes("fan1"); !equalEvents(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	availability := messages.waitFor(t, "state/fan1/availability", 3)
+	if strings.Join(availability, " ") != "online offline online" {
+		t.Errorf("availability = %v, want online, offline and online again", availability)
+	}
+}
@@ -0,0 +1,88 @@
+package control
+
+import (
+	"brightpod/pkg/blower"
+	"fmt"
+	"math"
+
+	"github.com/mochi-co/hanami"
+)
+
+const (
+	// valueKey is the key hanami wraps lone (non JSON object) payloads in.
+	valueKey = "v"
+)
+
+// Parse converts a control command and its payload into the blower settings it
+// requests. The "set" command takes a JSON object with any of the "mode",
+// "power" and "temperature" fields, every other command carries a single value.
+// Power percentages are converted into one of the given number of power steps.
+func Parse(command string, msg hanami.Msg, powerSteps int) (*blower.Settings, error) {
+	settings := &blower.Settings{}
+
+	switch command {
+	case "set":
+		for field, value := range msg {
+			if err := parseField(settings, field, value, powerSteps); err != nil {
+				return nil, err
+			}
+		}
+		if settings.Mode == nil && settings.FanPower == nil && settings.Temperature == nil {
+			return nil, fmt.Errorf("set command did not contain any fields")
+		}
+	case "mode", "power", "temperature":
+		value, ok := msg[valueKey]
+		if !ok {
+			return nil, fmt.Errorf("could not find a value for '%s'", command)
+		}
+		if err := parseField(settings, command, value, powerSteps); err != nil {
+			return nil, err
+		}
+	case "max_rpm":
+		// Changing the maximum rpm is not supported by the blower yet, the
+		// current status is republished as is.
+	default:
+		return nil, fmt.Errorf("unknown control command: %s", command)
+	}
+
+	return settings, nil
+}
+
+func parseField(settings *blower.Settings, field string, value interface{}, powerSteps int) error {
+	switch field {
+	case "mode":
+		mode, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("could not parse 'mode' from: %v", value)
+		}
+		settings.Mode = &mode
+	case "power":
+		percentage, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("could not parse 'power' from: %v", value)
+		}
+		power, err := PowerFromPercentage(percentage, powerSteps)
+		if err != nil {
+			return err
+		}
+		settings.FanPower = &power
+	case "temperature":
+		temperature, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("could not parse 'temperature' from: %v", value)
+		}
+		settings.Temperature = &temperature
+	default:
+		return fmt.Errorf("unknown field: %s", field)
+	}
+	return nil
+}
+
+// PowerFromPercentage converts a power percentage into the closest of the
+// given number of fan power steps.
+func PowerFromPercentage(percentage float64, powerSteps int) (int, error) {
+	if percentage < 0 || percentage > 100 {
+		return 0, fmt.Errorf("power percentage must be between 0 and 100, recieved: %v", percentage)
+	}
+	return int(math.Round(percentage * float64(powerSteps) / 100)), nil
+}
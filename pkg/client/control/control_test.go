@@ -0,0 +1,100 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/mochi-co/hanami"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		msg         hanami.Msg
+		powerSteps  int
+		mode        string
+		power       int
+		temperature float64
+		wantErr     bool
+	}{
+		{name: "mode", command: "mode", msg: hanami.Msg{"v": "eco"}, powerSteps: 12, mode: "eco", power: -1, temperature: -1},
+		{name: "power percentage", command: "power", msg: hanami.Msg{"v": 50.0}, powerSteps: 12, power: 6, temperature: -1},
+		{name: "power rounds to a step", command: "power", msg: hanami.Msg{"v": 30.0}, powerSteps: 4, power: 1, temperature: -1},
+		{name: "temperature", command: "temperature", msg: hanami.Msg{"v": 21.5}, powerSteps: 12, power: -1, temperature: 21.5},
+		{name: "set", command: "set", msg: hanami.Msg{"mode": "on", "power": 100.0, "temperature": 22.0}, powerSteps: 12, mode: "on", power: 12, temperature: 22},
+		{name: "set one field", command: "set", msg: hanami.Msg{"power": 0.0}, powerSteps: 12, power: 0, temperature: -1},
+		{name: "max rpm is accepted", command: "max_rpm", msg: hanami.Msg{"v": 10.0}, powerSteps: 12, power: -1, temperature: -1},
+		{name: "set without fields", command: "set", msg: hanami.Msg{}, powerSteps: 12, wantErr: true},
+		{name: "set with an unknown field", command: "set", msg: hanami.Msg{"speed": 1.0}, powerSteps: 12, wantErr: true},
+		{name: "missing value", command: "mode", msg: hanami.Msg{}, powerSteps: 12, wantErr: true},
+		{name: "mode is not a string", command: "mode", msg: hanami.Msg{"v": 1.0}, powerSteps: 12, wantErr: true},
+		{name: "power is not a number", command: "power", msg: hanami.Msg{"v": "high"}, powerSteps: 12, wantErr: true},
+		{name: "power above 100", command: "power", msg: hanami.Msg{"v": 101.0}, powerSteps: 12, wantErr: true},
+		{name: "negative power", command: "power", msg: hanami.Msg{"v": -1.0}, powerSteps: 12, wantErr: true},
+		{name: "temperature is not a number", command: "temperature", msg: hanami.Msg{"v": "warm"}, powerSteps: 12, wantErr: true},
+		{name: "unknown command", command: "reboot", msg: hanami.Msg{"v": 1.0}, powerSteps: 12, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := Parse(tt.command, tt.msg, tt.powerSteps)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", settings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if tt.mode == "" && settings.Mode != nil {
+				t.Errorf("mode = %s, want unset", *settings.Mode)
+			}
+			if tt.mode != "" && (settings.Mode == nil || *settings.Mode != tt.mode) {
+				t.Errorf("mode = %v, want %s", settings.Mode, tt.mode)
+			}
+			if tt.power < 0 && settings.FanPower != nil {
+				t.Errorf("power = %d, want unset", *settings.FanPower)
+			}
+			if tt.power >= 0 && (settings.FanPower == nil || *settings.FanPower != tt.power) {
+				t.Errorf("power = %v, want %d", settings.FanPower, tt.power)
+			}
+			if tt.temperature < 0 && settings.Temperature != nil {
+				t.Errorf("temperature = %v, want unset", *settings.Temperature)
+			}
+			if tt.temperature >= 0 && (settings.Temperature == nil || *settings.Temperature != tt.temperature) {
+				t.Errorf("temperature = %v, want %v", settings.Temperature, tt.temperature)
+			}
+		})
+	}
+}
+
+func TestPowerFromPercentage(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		powerSteps int
+		want       int
+		wantErr    bool
+	}{
+		{0, 12, 0, false},
+		{100, 12, 12, false},
+		{50, 12, 6, false},
+		{4, 12, 0, false},
+		{5, 12, 1, false},
+		{100, 1, 1, false},
+		{-0.1, 12, 0, true},
+		{100.1, 12, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := PowerFromPercentage(tt.percentage, tt.powerSteps)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("PowerFromPercentage(%v, %d) error = %v, want error %v", tt.percentage, tt.powerSteps, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("PowerFromPercentage(%v, %d) = %d, want %d", tt.percentage, tt.powerSteps, got, tt.want)
+		}
+	}
+}
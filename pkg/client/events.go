@@ -0,0 +1,93 @@
+package client
+
+import (
+	"brightpod/pkg/blower"
+	"time"
+)
+
+// EventType names what happened to a blower.
+type EventType string
+
+const (
+	// EventMonitored is sent for the first keepalive of a blower.
+	EventMonitored EventType = "monitored"
+	// EventReboot is sent when the uptime of a blower went back.
+	EventReboot EventType = "reboot"
+	// EventOnline and EventOffline are sent when the availability of a
+	// blower changes.
+	EventOnline  EventType = "online"
+	EventOffline EventType = "offline"
+	// EventConnected and EventDisconnected are sent when a blower opens its
+	// first or closes its last session on the embedded broker.
+	EventConnected    EventType = "connected"
+	EventDisconnected EventType = "disconnected"
+	// EventCommandSent is sent once a command reached the mqtt server, and
+	// EventCommandQueued when it waits for the blower to come online.
+	EventCommandSent   EventType = "command_sent"
+	EventCommandQueued EventType = "command_queued"
+	// EventChanged is sent for every change of the state of a blower.
+	EventChanged EventType = "changed"
+)
+
+// Event describes something that happened to a blower.
+type Event struct {
+	Type EventType `json:"type"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Command is the command of command events.
+	Command string `json:"command,omitempty"`
+	// Fields lists what changed and State is the resulting state, for
+	// change events.
+	Fields []blower.Field `json:"fields,omitempty"`
+	State  *blower.State  `json:"state,omitempty"`
+}
+
+// Subscribe calls the handler with every event from now on and returns an ID
+// to unsubscribe with. Handlers are called from the goroutine the event
+// happened on, and must not block.
+func (c *Controller) Subscribe(handler func(Event)) int {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	c.nextHandler++
+	c.handlers[c.nextHandler] = handler
+	return c.nextHandler
+}
+
+// Unsubscribe stops calling the handler with the given ID.
+func (c *Controller) Unsubscribe(id int) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	delete(c.handlers, id)
+}
+
+// emit calls every handler with the event.
+func (c *Controller) emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	c.handlersLock.Lock()
+	handlers := make([]func(Event), 0, len(c.handlers))
+	for _, handler := range c.handlers {
+		handlers = append(handlers, handler)
+	}
+	c.handlersLock.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// handleChange sends a change of a blower as an event.
+func (c *Controller) handleChange(change blower.Change) {
+	state := change.State
+	c.emit(Event{
+		Type:   EventChanged,
+		ID:     change.ID,
+		Time:   change.Time,
+		Fields: change.Fields,
+		State:  &state,
+	})
+}
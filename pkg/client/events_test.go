@@ -0,0 +1,30 @@
+package client
+
+import "testing"
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	c := New(Options{})
+	first, second := &recorder{}, &recorder{}
+	firstID := c.Subscribe(first.addEvent)
+	secondID := c.Subscribe(second.addEvent)
+	if firstID == secondID {
+		t.Fatalf("both handlers got the ID %d", firstID)
+	}
+
+	c.emit(Event{Type: EventOnline, ID: "fan1"})
+	c.Unsubscribe(firstID)
+	c.emit(Event{Type: EventOffline, ID: "fan1"})
+	// Unsubscribing twice or an unknown ID is harmless.
+	c.Unsubscribe(firstID)
+	c.Unsubscribe(secondID + 1)
+
+	if types := first.eventTypes("fan1"); !equalEvents(types, []EventType{EventOnline}) {
+		t.Errorf("unsubscribed handler got %v, want only online", types)
+	}
+	if types := second.eventTypes("fan1"); !equalEvents(types, []EventType{EventOnline, EventOffline}) {
+		t.Errorf("handler got %v, want online and offline", types)
+	}
+	if second.events[0].Time.IsZero() {
+		t.Errorf("event sent without a time")
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"brightpod/pkg/config"
+)
+
+// setInventory replaces the inventory and the blower IDs that accept queued
+// commands before they have been seen.
+func (c *Controller) setInventory(inv *config.Inventory, devices []string) {
+	ids := map[string]bool{}
+	for _, id := range devices {
+		ids[id] = true
+	}
+	for id := range inv.Devices {
+		ids[id] = true
+	}
+
+	c.inventoryLock.Lock()
+	for id := range c.paired {
+		ids[id] = true
+	}
+	c.inventory = inv
+	c.declared = ids
+	c.inventoryLock.Unlock()
+}
+
+func (c *Controller) currentInventory() *config.Inventory {
+	c.inventoryLock.RLock()
+	defer c.inventoryLock.RUnlock()
+	return c.inventory
+}
+
+func (c *Controller) isDeclared(id string) bool {
+	c.inventoryLock.RLock()
+	defer c.inventoryLock.RUnlock()
+	return c.declared[id]
+}
+
+// UpdateInventory applies a reloaded inventory without dropping any
+// connection. Every monitored blower gets its new profile and its Home
+// Assistant discovery is published again.
+func (c *Controller) UpdateInventory(inv *config.Inventory, devices []string) {
+	c.setInventory(inv, devices)
+
+	for _, blwr := range c.Blowers() {
+		blwr.SetProfile(inv.Profile(blwr.ID()))
+		if c.client.Socket.IsConnectionOpen() {
+			c.publishDiscovery(blwr, true)
+			c.publishBlowerState(blwr)
+		}
+	}
+	c.logger.Printf("Updated the inventory with %d devices", len(inv.Devices))
+}
+
+// RegisterDevice declares a blower paired at runtime, with the default
+// settings unless the inventory declares it. It stays declared across
+// reloads until brightpod restarts.
+func (c *Controller) RegisterDevice(id string) {
+	c.inventoryLock.Lock()
+	c.paired[id] = true
+	c.declared[id] = true
+	c.inventoryLock.Unlock()
+	c.logger.Printf("Registered paired blower %s", id)
+}
@@ -12,6 +12,12 @@ type keepAliveMsg struct {
 	FS float64
 	M  int
 	S  int
+
+	// Extended is set when the keepalive carried the uptime counters below.
+	Extended  bool
+	MS        int64
+	DiffStart int64
+	DiffStop  int64
 }
 
 func ParseKeepAlive(msg hanami.Msg) (*keepAliveMsg, error) {
@@ -51,5 +57,18 @@ func ParseKeepAlive(msg hanami.Msg) (*keepAliveMsg, error) {
 		keepalive.S = int(s)
 	}
 
+	// The extended keepalive additionally reports the milliseconds since boot.
+	if ms, ok := msg["ms"].(float64); ok {
+		keepalive.Extended = true
+		keepalive.MS = int64(ms)
+
+		if diffStart, ok := msg["diffstart"].(float64); ok {
+			keepalive.DiffStart = int64(diffStart)
+		}
+		if diffStop, ok := msg["diffstop"].(float64); ok {
+			keepalive.DiffStop = int64(diffStop)
+		}
+	}
+
 	return keepalive, nil
 }
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"brightpod/pkg/topics"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mochi-co/hanami"
+)
+
+// publishTimeout bounds the wait for the mqtt server to take a message.
+const publishTimeout = 10 * time.Second
+
+// availabilityDelivery is used for the availability of blowers and of
+// brightpod, matching its last will.
+var availabilityDelivery = topics.Delivery{QoS: 1, Retain: true}
+
+// publish sends a payload the way hanami does, strings as is and anything
+// else as JSON, and waits until the mqtt server took it.
+func publish(client *hanami.Client, topic string, options topics.Delivery, payload interface{}) error {
+	var b []byte
+	switch p := payload.(type) {
+	case string:
+		b = []byte(p)
+	default:
+		var err error
+		if b, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	token := client.Socket.Publish(topic, options.QoS, options.Retain, b)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publish to %s timed out after %s", topic, publishTimeout)
+	}
+	return token.Error()
+}
@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"brightpod/pkg/blower"
+	"sync"
+	"time"
+)
+
+// Command is a control command waiting for its blower to come online.
+type Command struct {
+	Command  string          `json:"command"`
+	Settings blower.Settings `json:"settings"`
+	Queued   time.Time       `json:"queued"`
+	Expires  time.Time       `json:"expires"`
+}
+
+// Queue holds commands for blowers that are offline, keyed on blower ID.
+// Commands that are not delivered before their expiry are discarded.
+type Queue struct {
+	sync.Mutex
+	ttl      time.Duration
+	commands map[string][]Command
+}
+
+func New(ttl time.Duration) *Queue {
+	return &Queue{
+		ttl:      ttl,
+		commands: map[string][]Command{},
+	}
+}
+
+// SetTTL changes the expiry of commands queued from now on.
+func (queue *Queue) SetTTL(ttl time.Duration) {
+	queue.Lock()
+	queue.ttl = ttl
+	queue.Unlock()
+}
+
+// Push queues a command for the given blower.
+func (queue *Queue) Push(id, command string, settings blower.Settings) Command {
+	queue.Lock()
+	defer queue.Unlock()
+
+	now := time.Now()
+	cmd := Command{
+		Command:  command,
+		Settings: settings,
+		Queued:   now,
+		Expires:  now.Add(queue.ttl),
+	}
+	queue.commands[id] = append(queue.commands[id], cmd)
+	return cmd
+}
+
+// Pop removes and returns the unexpired commands for the given blower in the
+// order they were queued.
+func (queue *Queue) Pop(id string) []Command {
+	queue.Lock()
+	defer queue.Unlock()
+
+	commands := unexpired(queue.commands[id], time.Now())
+	delete(queue.commands, id)
+	return commands
+}
+
+// Requeue puts back commands that could not be delivered, ahead of the ones
+// queued since and keeping their expiry.
+func (queue *Queue) Requeue(id string, commands []Command) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	queue.commands[id] = append(append([]Command{}, commands...), queue.commands[id]...)
+}
+
+// Pending returns the unexpired commands for the given blower without
+// removing them.
+func (queue *Queue) Pending(id string) []Command {
+	queue.Lock()
+	defer queue.Unlock()
+
+	return unexpired(queue.commands[id], time.Now())
+}
+
+// All returns the unexpired commands of every blower, dropping any blower
+// whose commands have all expired.
+func (queue *Queue) All() map[string][]Command {
+	queue.Lock()
+	defer queue.Unlock()
+
+	now := time.Now()
+	all := map[string][]Command{}
+	for id, commands := range queue.commands {
+		pending := unexpired(commands, now)
+		if len(pending) == 0 {
+			delete(queue.commands, id)
+			continue
+		}
+		queue.commands[id] = pending
+		all[id] = pending
+	}
+	return all
+}
+
+func unexpired(commands []Command, now time.Time) []Command {
+	pending := []Command{}
+	for _, cmd := range commands {
+		if now.Before(cmd.Expires) {
+			pending = append(pending, cmd)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"brightpod/pkg/blower"
+	"testing"
+	"time"
+)
+
+func power(p int) blower.Settings {
+	return blower.Settings{FanPower: &p}
+}
+
+func commandNames(commands []Command) []string {
+	names := []string{}
+	for _, cmd := range commands {
+		names = append(names, cmd.Command)
+	}
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPushAndPop(t *testing.T) {
+	queue := New(time.Minute)
+	queued := queue.Push("fan1", "power", power(3))
+	queue.Push("fan1", "mode", power(4))
+	queue.Push("fan2", "set", power(5))
+
+	if got := queued.Expires.Sub(queued.Queued); got != time.Minute {
+		t.Errorf("expiry is %s after queueing, want 1m", got)
+	}
+	if got := commandNames(queue.Pending("fan1")); !equal(got, []string{"power", "mode"}) {
+		t.Errorf("pending = %v", got)
+	}
+	if got := commandNames(queue.Pop("fan1")); !equal(got, []string{"power", "mode"}) {
+		t.Errorf("popped = %v, want the commands in the order they were queued", got)
+	}
+	if got := queue.Pop("fan1"); len(got) != 0 {
+		t.Errorf("popped %v a second time", commandNames(got))
+	}
+	if got := commandNames(queue.Pending("fan2")); !equal(got, []string{"set"}) {
+		t.Errorf("other blower lost its commands: %v", got)
+	}
+}
+
+func TestExpiredCommandsAreDropped(t *testing.T) {
+	queue := New(-time.Second)
+	queue.Push("fan1", "power", power(3))
+	queue.SetTTL(time.Minute)
+	queue.Push("fan1", "mode", power(4))
+
+	if got := commandNames(queue.Pending("fan1")); !equal(got, []string{"mode"}) {
+		t.Errorf("pending = %v, want only the unexpired command", got)
+	}
+
+	queue.SetTTL(-time.Second)
+	queue.Push("fan2", "power", power(1))
+	all := queue.All()
+	if _, ok := all["fan2"]; ok {
+		t.Errorf("All returned a blower with only expired commands")
+	}
+	if got := commandNames(all["fan1"]); !equal(got, []string{"mode"}) {
+		t.Errorf("All()[fan1] = %v", got)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	queue := New(time.Minute)
+	queue.Push("fan1", "power", power(3))
+	queue.Push("fan1", "mode", power(4))
+	popped := queue.Pop("fan1")
+	queue.Push("fan1", "temperature", power(5))
+
+	queue.Requeue("fan1", popped)
+	pending := queue.Pending("fan1")
+	if got := commandNames(pending); !equal(got, []string{"power", "mode", "temperature"}) {
+		t.Fatalf("pending = %v, want the requeued commands first", got)
+	}
+	if !pending[0].Expires.Equal(popped[0].Expires) {
+		t.Errorf("requeued command expires at %s, want %s", pending[0].Expires, popped[0].Expires)
+	}
+
+	// Expired requeued commands are still dropped.
+	expired := []Command{{Command: "old", Expires: time.Now().Add(-time.Second)}}
+	queue.Requeue("fan2", expired)
+	if got := queue.Pop("fan2"); len(got) != 0 {
+		t.Errorf("popped expired requeued commands: %v", commandNames(got))
+	}
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ConnectionState describes the connection of brightpod to the mqtt server.
+type ConnectionState struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	// Connects counts the connections made, the first one included.
+	Connects  int    `json:"connects"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// subscriptionSocket remembers the filters subscribed through it, so that
+// they can be subscribed again after reconnecting. paho keeps the handlers
+// of the filters across reconnects, but not the subscriptions of a clean
+// session.
+type subscriptionSocket struct {
+	paho.Client
+
+	lock    sync.Mutex
+	filters map[string]byte
+}
+
+func newSubscriptionSocket(c paho.Client) *subscriptionSocket {
+	return &subscriptionSocket{
+		Client:  c,
+		filters: map[string]byte{},
+	}
+}
+
+func (s *subscriptionSocket) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	s.lock.Lock()
+	s.filters[topic] = qos
+	s.lock.Unlock()
+	return s.Client.Subscribe(topic, qos, callback)
+}
+
+func (s *subscriptionSocket) Unsubscribe(topics ...string) paho.Token {
+	s.lock.Lock()
+	for _, topic := range topics {
+		delete(s.filters, topic)
+	}
+	s.lock.Unlock()
+	return s.Client.Unsubscribe(topics...)
+}
+
+// resubscribe subscribes to every remembered filter again, keeping their
+// handlers.
+func (s *subscriptionSocket) resubscribe() error {
+	s.lock.Lock()
+	filters := make(map[string]byte, len(s.filters))
+	for filter, qos := range s.filters {
+		filters[filter] = qos
+	}
+	s.lock.Unlock()
+	if len(filters) == 0 {
+		return nil
+	}
+
+	token := s.Client.SubscribeMultiple(filters, nil)
+	if token.Wait(); token.Error() != nil {
+		return token.Error()
+	}
+	for filter, qos := range token.(*paho.SubscribeToken).Result() {
+		if qos == 0x80 {
+			return fmt.Errorf("subscription to %s was refused", filter)
+		}
+	}
+	return nil
+}
+
+// Connection returns the state of the connection to the mqtt server.
+func (c *Controller) Connection() ConnectionState {
+	c.connectionStateLock.Lock()
+	defer c.connectionStateLock.Unlock()
+	return c.connectionState
+}
+
+// setConnected records a change of the connection and returns the number of
+// connections made so far.
+func (c *Controller) setConnected(connected bool, err error) int {
+	c.connectionStateLock.Lock()
+	defer c.connectionStateLock.Unlock()
+	if connected != c.connectionState.Connected || c.connectionState.Since.IsZero() {
+		c.connectionState.Since = time.Now()
+	}
+	c.connectionState.Connected = connected
+	if connected {
+		c.connectionState.Connects++
+	}
+	if err != nil {
+		c.connectionState.LastError = err.Error()
+	}
+	return c.connectionState.Connects
+}
+
+// setReconnect makes the client reconnect with exponential backoff after
+// losing the connection, subscribe again once reconnected, and leave a last
+// will marking brightpod offline.
+func (c *Controller) setReconnect(options *paho.ClientOptions) {
+	options.SetClientID(c.opts.ClientID)
+	options.SetCleanSession(c.opts.CleanSession)
+	options.SetAutoReconnect(true)
+	options.SetMaxReconnectInterval(c.opts.MaxRetryInterval)
+	options.SetWill(c.layout.ServiceTopic(), availabilityOffline, 1, true)
+
+	options.SetOnConnectHandler(func(paho.Client) {
+		if c.setConnected(true, nil) > 1 && !c.isStopping() {
+			c.logger.Printf("Reconnected to the mqtt server, subscribing again")
+			if err := c.socket.resubscribe(); err != nil {
+				c.logger.Printf("Could not subscribe again after reconnecting: %s", err)
+			}
+		}
+		c.publishServiceAvailability(true)
+	})
+	options.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		c.setConnected(false, err)
+		c.logger.Printf("Lost the connection to the mqtt server: %s", err)
+	})
+	options.SetReconnectingHandler(func(paho.Client, *paho.ClientOptions) {
+		c.logger.Printf("Reconnecting to the mqtt server")
+	})
+}
+
+// connect connects to the mqtt server, retrying with exponential backoff up
+// to MaxRetryInterval. It gives up after ConnectAttempts, unless it is 0, or
+// once the context is done.
+func (c *Controller) connect(ctx context.Context) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := c.client.Connect()
+		if err == nil {
+			return nil
+		}
+		c.setConnected(false, err)
+		if c.opts.ConnectAttempts > 0 && attempt >= c.opts.ConnectAttempts {
+			return err
+		}
+
+		if delay > c.opts.MaxRetryInterval {
+			delay = c.opts.MaxRetryInterval
+		}
+		c.logger.Printf("Could not connect to the mqtt server, retrying in %s: %s", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// publishServiceAvailability publishes whether brightpod itself is online,
+// the opposite of its last will.
+func (c *Controller) publishServiceAvailability(online bool) {
+	value := availabilityOffline
+	if online {
+		value = availabilityOnline
+	}
+	if err := publish(c.client, c.layout.ServiceTopic(), availabilityDelivery, value); err != nil {
+		c.logger.Printf("Could not publish the availability of brightpod: %s", err)
+	}
+}
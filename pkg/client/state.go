@@ -0,0 +1,102 @@
+package client
+
+import (
+	"brightpod/pkg/blower"
+	"brightpod/pkg/homeassistant"
+	"time"
+
+	"github.com/mochi-co/hanami"
+)
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// publishBlowerState publishes the current state of a blower as JSON for
+// integrations such as Home Assistant.
+func (c *Controller) publishBlowerState(blwr *blower.Blower) {
+	state := blwr.Snapshot()
+	payload := hanami.Msg{
+		"mode":        state.Mode,
+		"running":     state.Running,
+		"power":       state.FanPowerPercentage(),
+		"temperature": state.Temperature,
+		"last_seen":   state.LastContact.Format(time.RFC3339),
+	}
+	if err := publish(c.client, c.layout.StateTopic(blwr.ID()), c.delivery.State, payload); err != nil {
+		c.logger.Printf("Could not publish state for blower %s: %s", blwr.ID(), err)
+	}
+}
+
+// publishAvailability publishes whether a blower is online, skipping the
+// publish when the availability did not change. Blowers stay offline once
+// the client shuts down. It is sent with QoS 1 so that the broker has taken
+// it, and the messages sent before it, once it returns.
+func (c *Controller) publishAvailability(id string, online bool) {
+	if online && c.isStopping() {
+		return
+	}
+	value := availabilityOffline
+	if online {
+		value = availabilityOnline
+	}
+	if previous, ok := c.availability.Get(id); ok && previous.(string) == value {
+		return
+	}
+	if err := publish(c.client, c.layout.AvailabilityTopic(id), availabilityDelivery, value); err != nil {
+		c.logger.Printf("Could not publish availability for blower %s: %s", id, err)
+		return
+	}
+	c.availability.Set(id, value)
+	if online {
+		c.emit(Event{Type: EventOnline, ID: id})
+	} else {
+		c.emit(Event{Type: EventOffline, ID: id})
+	}
+}
+
+// monitorAvailability marks blowers offline once they stop sending keepalives.
+func (c *Controller) monitorAvailability(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, blwr := range c.Blowers() {
+				c.publishAvailability(blwr.ID(), c.isOnline(blwr))
+			}
+		}
+	}
+}
+
+// publishDiscovery announces a blower to Home Assistant when it is enabled
+// for the blower. With remove set, a blower that is not enabled is removed
+// from Home Assistant instead.
+func (c *Controller) publishDiscovery(blwr *blower.Blower, remove bool) {
+	options := c.currentInventory().HomeAssistantOptions(blwr.ID())
+	if !options.Enabled && !remove {
+		return
+	}
+
+	topics := homeassistant.Topics{
+		State:        c.layout.StateTopic(blwr.ID()),
+		Availability: c.layout.AvailabilityTopic(blwr.ID()),
+		Control: func(command string) string {
+			return c.layout.ControlTopic(blwr.ID(), command)
+		},
+	}
+	for topic, payload := range homeassistant.Discovery(blwr.ID(), blwr.Profile(), options, topics) {
+		var msg interface{} = payload
+		if !options.Enabled {
+			// An empty retained config removes the entity.
+			msg = ""
+		}
+		if err := publish(c.client, topic, c.delivery.Discovery, msg); err != nil {
+			c.logger.Printf("Could not publish discovery for blower %s: %s", blwr.ID(), err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"brightpod/pkg/mqtt"
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSConfig returns the TLS configuration used with ssl://, tls:// and wss://
+// servers. The CA replaces the system roots when set, and the certificate and
+// key authenticate brightpod to servers that require client certificates.
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := mqtt.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("a client certificate needs both a certificate and a key")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
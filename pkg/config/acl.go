@@ -0,0 +1,46 @@
+package config
+
+import (
+	"brightpod/pkg/mqtt"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// ACLEntry holds the topic rules of one user of the built-in mqtt server.
+type ACLEntry struct {
+	User      string `mapstructure:"user" yaml:"user"`
+	mqtt.Rule `mapstructure:",squash" yaml:",inline"`
+}
+
+// LoadACL reads the "acl" section of the configuration and returns the rules
+// keyed on username. It is a list rather than a map so that usernames keep
+// their case.
+func LoadACL(v *viper.Viper) (map[string]mqtt.Rule, error) {
+	var entries []ACLEntry
+	if err := decode(v.Get("acl"), &entries); err != nil {
+		return nil, fmt.Errorf("could not parse acl: %w", err)
+	}
+
+	rules := map[string]mqtt.Rule{}
+	errs := Errors{}
+	for i, entry := range entries {
+		if entry.User == "" {
+			errs = append(errs, fmt.Errorf("acl entry %d does not have a user", i))
+			continue
+		}
+		if _, ok := rules[entry.User]; ok {
+			errs = append(errs, fmt.Errorf("acl for user %s is declared more than once", entry.User))
+			continue
+		}
+		if err := entry.Rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("acl for user %s: %w", entry.User, err))
+			continue
+		}
+		rules[entry.User] = entry.Rule
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return rules, nil
+}
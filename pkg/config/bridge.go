@@ -0,0 +1,25 @@
+package config
+
+import (
+	"brightpod/pkg/mqtt"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// LoadBridge reads the "bridge" section of the configuration. It returns nil
+// when the section is missing.
+func LoadBridge(v *viper.Viper) (*mqtt.BridgeOptions, error) {
+	if !v.IsSet("bridge") {
+		return nil, nil
+	}
+
+	var bridge mqtt.BridgeOptions
+	if err := decode(v.Get("bridge"), &bridge); err != nil {
+		return nil, fmt.Errorf("could not parse bridge: %w", err)
+	}
+	if err := bridge.Validate(); err != nil {
+		return nil, fmt.Errorf("bridge: %w", err)
+	}
+	return &bridge, nil
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"brightpod/pkg/blower"
+	"brightpod/pkg/homeassistant"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Device is a blower declared in the device inventory of the configuration file.
+type Device struct {
+	ID             string `mapstructure:"id" yaml:"id"`
+	blower.Profile `mapstructure:",squash" yaml:",inline"`
+
+	// HomeAssistant overrides the global Home Assistant options for this device.
+	HomeAssistant *homeassistant.Options `mapstructure:"homeassistant" yaml:"homeassistant,omitempty"`
+}
+
+// Inventory holds the configuration of every declared blower, keyed on ID.
+type Inventory struct {
+	Devices       map[string]Device
+	HomeAssistant homeassistant.Options
+}
+
+// Errors collects every problem found in the configuration.
+type Errors []error
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// LoadInventory reads the "devices" and "homeassistant" sections of the
+// configuration. Values missing from a device are taken from the default
+// profile. Every invalid or unknown key is reported as one of the Errors.
+func LoadInventory(v *viper.Viper) (*Inventory, error) {
+	inventory := &Inventory{
+		Devices: map[string]Device{},
+	}
+	errs := Errors{}
+
+	if err := decode(v.Get("homeassistant"), &inventory.HomeAssistant); err != nil {
+		errs = append(errs, fmt.Errorf("could not parse homeassistant: %w", err))
+	}
+
+	var devices []map[string]interface{}
+	if err := decode(v.Get("devices"), &devices); err != nil {
+		errs = append(errs, fmt.Errorf("could not parse devices: %w", err))
+	}
+
+	for i, raw := range devices {
+		device := Device{Profile: blower.DefaultProfile()}
+		if err := decode(raw, &device); err != nil {
+			errs = append(errs, fmt.Errorf("could not parse device %d: %w", i, err))
+			continue
+		}
+		if device.ID == "" {
+			errs = append(errs, fmt.Errorf("device %d does not have an id", i))
+			continue
+		}
+		if _, ok := inventory.Devices[device.ID]; ok {
+			errs = append(errs, fmt.Errorf("device %s is declared more than once", device.ID))
+			continue
+		}
+		if err := device.Profile.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", device.ID, err))
+			continue
+		}
+		inventory.Devices[device.ID] = device
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return inventory, nil
+}
+
+// Profile returns the profile of the given blower, falling back to the
+// default profile for blowers that are not declared.
+func (inventory *Inventory) Profile(id string) blower.Profile {
+	if device, ok := inventory.Devices[id]; ok {
+		return device.Profile
+	}
+	return blower.DefaultProfile()
+}
+
+// HomeAssistantOptions returns the Home Assistant options of the given blower.
+func (inventory *Inventory) HomeAssistantOptions(id string) homeassistant.Options {
+	if device, ok := inventory.Devices[id]; ok && device.HomeAssistant != nil {
+		options := *device.HomeAssistant
+		if options.DiscoveryPrefix == "" {
+			options.DiscoveryPrefix = inventory.HomeAssistant.DiscoveryPrefix
+		}
+		return options
+	}
+	return inventory.HomeAssistant
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// decode decodes a raw configuration section on top of the given value the
+// same way viper does, keeping any field that is missing from the section and
+// failing on keys that do not exist.
+func decode(input interface{}, output interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           output,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := decoder.Decode(input); err != nil {
+		if decodeErr, ok := err.(*mapstructure.Error); ok {
+			return errors.New(strings.TrimPrefix(strings.Join(decodeErr.Errors, ", "), "'' "))
+		}
+		return err
+	}
+	return nil
+}
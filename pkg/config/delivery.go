@@ -0,0 +1,21 @@
+package config
+
+import (
+	"brightpod/pkg/topics"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// LoadDelivery reads the "delivery" section of the configuration on top of
+// the default delivery options.
+func LoadDelivery(v *viper.Viper) (topics.DeliveryOptions, error) {
+	options := topics.DefaultDeliveryOptions()
+	if err := decode(v.Get("delivery"), &options); err != nil {
+		return options, fmt.Errorf("could not parse delivery: %w", err)
+	}
+	if err := options.Validate(); err != nil {
+		return options, err
+	}
+	return options, nil
+}
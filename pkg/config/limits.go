@@ -0,0 +1,48 @@
+package config
+
+import (
+	"brightpod/pkg/mqtt"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// AnyUser is the user of the limits entry applied to users without one.
+const AnyUser = "*"
+
+// LimitsEntry holds the limits of one user of the built-in mqtt server.
+type LimitsEntry struct {
+	User        string `mapstructure:"user" yaml:"user"`
+	mqtt.Limits `mapstructure:",squash" yaml:",inline"`
+}
+
+// LoadLimits reads the "limits" section of the configuration and returns the
+// limits keyed on username, with AnyUser for the default limits.
+func LoadLimits(v *viper.Viper) (map[string]mqtt.Limits, error) {
+	var entries []LimitsEntry
+	if err := decode(v.Get("limits"), &entries); err != nil {
+		return nil, fmt.Errorf("could not parse limits: %w", err)
+	}
+
+	limits := map[string]mqtt.Limits{}
+	errs := Errors{}
+	for i, entry := range entries {
+		if entry.User == "" {
+			errs = append(errs, fmt.Errorf("limits entry %d does not have a user", i))
+			continue
+		}
+		if _, ok := limits[entry.User]; ok {
+			errs = append(errs, fmt.Errorf("limits for user %s are declared more than once", entry.User))
+			continue
+		}
+		if err := entry.Limits.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("limits for user %s: %w", entry.User, err))
+			continue
+		}
+		limits[entry.User] = entry.Limits
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return limits, nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"brightpod/pkg/mqtt"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// LoadListeners reads the "listeners" section of the configuration. It
+// returns no listeners when the section is missing.
+func LoadListeners(v *viper.Viper) ([]mqtt.ListenerOptions, error) {
+	var listeners []mqtt.ListenerOptions
+	if err := decode(v.Get("listeners"), &listeners); err != nil {
+		return nil, fmt.Errorf("could not parse listeners: %w", err)
+	}
+
+	errs := Errors{}
+	addresses := map[string]bool{}
+	for i, listener := range listeners {
+		if err := listener.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %d: %w", i, err))
+			continue
+		}
+		if addresses[listener.Address] {
+			errs = append(errs, fmt.Errorf("listener %d: address %s is used more than once", i, listener.Address))
+			continue
+		}
+		addresses[listener.Address] = true
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return listeners, nil
+}
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"brightpod/pkg/topics"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// LoadTopics reads the "topics" section of the configuration on top of the
+// default topic layout.
+func LoadTopics(v *viper.Viper) (topics.Layout, error) {
+	layout := topics.DefaultLayout()
+	if err := decode(v.Get("topics"), &layout); err != nil {
+		return layout, fmt.Errorf("could not parse topics: %w", err)
+	}
+	if err := layout.Validate(); err != nil {
+		return layout, err
+	}
+	return layout, nil
+}
@@ -0,0 +1,83 @@
+package homeassistant
+
+import (
+	"brightpod/pkg/blower"
+	"fmt"
+
+	"github.com/mochi-co/hanami"
+)
+
+const (
+	DefaultDiscoveryPrefix = "homeassistant"
+)
+
+// Options configures the Home Assistant MQTT discovery of a blower.
+type Options struct {
+	Enabled         bool   `mapstructure:"enabled" yaml:"enabled"`
+	DiscoveryPrefix string `mapstructure:"discovery-prefix" yaml:"discovery-prefix,omitempty"`
+}
+
+// Topics are the brightpod topics a discovered entity reads from and writes to.
+type Topics struct {
+	State        string
+	Availability string
+	Control      func(command string) string
+}
+
+// Discovery returns the retained discovery messages, keyed on topic, that make
+// Home Assistant create a fan and a target temperature entity for the blower.
+func Discovery(id string, profile blower.Profile, options Options, topics Topics) map[string]hanami.Msg {
+	prefix := options.DiscoveryPrefix
+	if prefix == "" {
+		prefix = DefaultDiscoveryPrefix
+	}
+
+	uniqueID := fmt.Sprintf("brightpod_%s", id)
+	name := profile.Name
+	if name == "" {
+		name = id
+	}
+
+	device := hanami.Msg{
+		"identifiers":  []string{uniqueID},
+		"name":         name,
+		"manufacturer": "Brightpod",
+	}
+	if profile.Room != "" {
+		device["suggested_area"] = profile.Room
+	}
+
+	return map[string]hanami.Msg{
+		fmt.Sprintf("%s/fan/%s/config", prefix, uniqueID): {
+			"name":                       name,
+			"unique_id":                  uniqueID,
+			"device":                     device,
+			"availability_topic":         topics.Availability,
+			"state_topic":                topics.State,
+			"state_value_template":       "{{ 'off' if value_json.mode == 'off' else 'on' }}",
+			"command_topic":              topics.Control("mode"),
+			"payload_on":                 "on",
+			"payload_off":                "off",
+			"percentage_state_topic":     topics.State,
+			"percentage_value_template":  "{{ value_json.power }}",
+			"percentage_command_topic":   topics.Control("power"),
+			"preset_mode_state_topic":    topics.State,
+			"preset_mode_value_template": "{{ value_json.mode }}",
+			"preset_mode_command_topic":  topics.Control("mode"),
+			"preset_modes":               []string{"on", "auto", "eco"},
+		},
+		fmt.Sprintf("%s/number/%s_temperature/config", prefix, uniqueID): {
+			"name":                fmt.Sprintf("%s target temperature", name),
+			"unique_id":           fmt.Sprintf("%s_temperature", uniqueID),
+			"device":              device,
+			"availability_topic":  topics.Availability,
+			"state_topic":         topics.State,
+			"value_template":      "{{ value_json.temperature }}",
+			"command_topic":       topics.Control("temperature"),
+			"min":                 profile.Temperature.Min,
+			"max":                 profile.Temperature.Max,
+			"step":                0.5,
+			"unit_of_measurement": "°C",
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule lists the topics a user of the built-in server may subscribe to (read)
+// and publish to (write). Patterns use the mqtt + and # wildcards.
+type Rule struct {
+	Read  []string `mapstructure:"read" yaml:"read"`
+	Write []string `mapstructure:"write" yaml:"write"`
+}
+
+// FullAccess returns a rule allowing every topic.
+func FullAccess() Rule {
+	return Rule{
+		Read:  []string{"#"},
+		Write: []string{"#"},
+	}
+}
+
+// Validate checks that every pattern is a valid topic filter.
+func (rule Rule) Validate() error {
+	for _, pattern := range append(append([]string{}, rule.Read...), rule.Write...) {
+		if err := validateFilter(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the rule allows publishing to a topic, or
+// subscribing to a filter when write is false. A subscription is only allowed
+// when every topic it can match is allowed.
+func (rule Rule) Allows(topic string, write bool) bool {
+	patterns := rule.Read
+	if write {
+		patterns = rule.Write
+	}
+	for _, pattern := range patterns {
+		if covers(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether every topic matched by filter is matched by pattern.
+func covers(pattern, filter string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, level := range patternLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) || filterLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != filterLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(filterLevels)
+}
+
+func validateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("topic pattern cannot be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return fmt.Errorf("wildcards must take up a whole level: %s", filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("# must be the last level: %s", filter)
+		}
+	}
+	return nil
+}
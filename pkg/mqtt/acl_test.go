@@ -0,0 +1,89 @@
+package mqtt
+
+import "testing"
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		want    bool
+	}{
+		{"fan1/keep_alive", "fan1/keep_alive", true},
+		{"fan1/keep_alive", "fan2/keep_alive", false},
+		{"fan1/keep_alive", "fan1", false},
+		{"fan1", "fan1/keep_alive", false},
+		{"+/keep_alive", "fan1/keep_alive", true},
+		{"+/keep_alive", "+/keep_alive", true},
+		{"+/keep_alive", "fan1/status", false},
+		{"fan1/keep_alive", "+/keep_alive", false},
+		{"control/+/+", "control/fan1/mode", true},
+		{"control/+/+", "control/fan1", false},
+		{"#", "anything/at/all", true},
+		{"#", "#", true},
+		{"state/#", "state", true},
+		{"state/#", "state/fan1/availability", true},
+		{"state/#", "state/+", true},
+		{"state/#", "events/fan1", false},
+		{"state/+", "state/#", false},
+		{"state/fan1", "state/#", false},
+		{"state/+/availability", "state/#", false},
+	}
+
+	for _, tt := range tests {
+		if got := covers(tt.pattern, tt.filter); got != tt.want {
+			t.Errorf("covers(%s, %s) = %v, want %v", tt.pattern, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		wantErr bool
+	}{
+		{"fan1/keep_alive", false},
+		{"+/keep_alive", false},
+		{"state/#", false},
+		{"#", false},
+		{"+", false},
+		{"", true},
+		{"fan+/keep_alive", true},
+		{"state/fan#", true},
+		{"state/#/availability", true},
+		{"state/++", true},
+	}
+
+	for _, tt := range tests {
+		err := validateFilter(tt.filter)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateFilter(%q) error = %v, want error %v", tt.filter, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRuleAllows(t *testing.T) {
+	rule := Rule{
+		Read:  []string{"state/#", "fan1/status"},
+		Write: []string{"fan1/keep_alive"},
+	}
+
+	tests := []struct {
+		topic string
+		write bool
+		want  bool
+	}{
+		{"state/fan1", false, true},
+		{"state/#", false, true},
+		{"fan1/status", false, true},
+		{"+/status", false, false},
+		{"fan1/keep_alive", false, false},
+		{"fan1/keep_alive", true, true},
+		{"state/fan1", true, false},
+	}
+
+	for _, tt := range tests {
+		if got := rule.Allows(tt.topic, tt.write); got != tt.want {
+			t.Errorf("Allows(%s, write %v) = %v, want %v", tt.topic, tt.write, got, tt.want)
+		}
+	}
+}
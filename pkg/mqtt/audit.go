@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	AuditConnect   = "connect"
+	AuditPublish   = "publish"
+	AuditSubscribe = "subscribe"
+)
+
+const (
+	AuditEmptyCredentials   = "empty username or password"
+	AuditUnknownUser        = "unknown user"
+	AuditPasswordMismatch   = "password mismatch"
+	AuditLockedOut          = "locked out"
+	AuditPaired             = "paired"
+	AuditNoCertificate      = "no client certificate"
+	AuditCertificateOfOther = "client certificate of another user"
+	AuditNoRule             = "no rule allows it"
+)
+
+// AuditEvent records an authentication or a topic access decision of the
+// server.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Allowed    bool      `json:"allowed"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr"`
+	Listener   string    `json:"listener"`
+	Topic      string    `json:"topic,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func (event AuditEvent) String() string {
+	s := fmt.Sprintf("action=%s allowed=%t user=%q addr=%s listener=%s", event.Action, event.Allowed, event.Username, event.RemoteAddr, event.Listener)
+	if event.Topic != "" {
+		s += fmt.Sprintf(" topic=%q", event.Topic)
+	}
+	if event.Reason != "" {
+		s += fmt.Sprintf(" reason=%q", event.Reason)
+	}
+	return s
+}
+
+// SetAuditHandler sets a function called with every audit event. Without
+// it, only connections and denied topics are logged. It must be called
+// before Start.
+func (server *Server) SetAuditHandler(handler func(event AuditEvent)) {
+	server.onAudit = handler
+}
+
+func (server *Server) audit(event AuditEvent) {
+	event.Time = time.Now()
+	if event.Action == AuditConnect || !event.Allowed {
+		log.Printf("Audit: %s", event)
+	}
+	if server.onAudit != nil {
+		server.onAudit(event)
+	}
+}
+
+// AuditLog writes audit events as JSON lines.
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+func (l *AuditLog) Write(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode audit event: %s", err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Could not write audit event: %s", err)
+	}
+}
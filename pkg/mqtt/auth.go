@@ -1,27 +1,166 @@
 package mqtt
 
 import (
-	cmap "github.com/orcaman/concurrent-map"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 )
 
-// Auth is an example auth provider for the server.
+// Auth authenticates a single connection to the server and checks the topic
+// rules of the user it authenticated as.
 type Auth struct {
-	authFn func(user, password []byte) bool
+	server   *Server
+	listener string
+	conn     net.Conn
+	packets  *conn
 
-	users cmap.ConcurrentMap
+	// method is how the connection authenticates: AuthPassword,
+	// AuthCertificate or authInProcess.
+	method   string
+	username string
+	clientID string
+
+	lock   sync.Mutex
+	reason string
 }
 
 func (a *Auth) Authenticate(user, password []byte) bool {
-	return a.authFn(user, password)
+	a.clientID = a.packets.clientID()
+	switch a.method {
+	case AuthCertificate:
+		return a.authenticateCertificate(string(user))
+	case authInProcess:
+		return a.authenticateInProcess()
+	}
+	if a.server.login(a.listener, a.conn.RemoteAddr().String(), string(user), string(password), true) {
+		a.username = string(user)
+		a.connected()
+		return true
+	}
+	return false
+}
+
+func (a *Auth) connected() {
+	a.packets.setPublishCheck(a.checkPayload)
+	a.server.sessions.add(a)
+	a.server.connectionEvent(a, true, "")
+}
+
+// close closes the connection, which ends with the given reason.
+func (a *Auth) close(reason string) {
+	a.lock.Lock()
+	a.reason = reason
+	a.lock.Unlock()
+	a.conn.Close()
 }
 
+func (a *Auth) closeReason() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.reason
+}
+
+// ACL checks the rules of the authenticated user, which for client
+// certificates is not the username sent by the client.
 func (a *Auth) ACL(user []byte, topic string, write bool) bool {
+	if a.closeReason() != "" {
+		// Packets read before the connection was closed, such as a publish
+		// rejected along with the CONNECT packet, are not let through.
+		return false
+	}
+	event := AuditEvent{
+		Action:     AuditSubscribe,
+		Allowed:    a.server.rule(a.username).Allows(topic, write),
+		Username:   a.username,
+		RemoteAddr: a.conn.RemoteAddr().String(),
+		Listener:   a.listener,
+		Topic:      topic,
+	}
+	if write {
+		event.Action = AuditPublish
+	}
+	exceeded := ""
+	if !event.Allowed {
+		event.Reason = AuditNoRule
+	} else if exceeded = a.checkLimits(topic, write); exceeded != "" {
+		event.Allowed = false
+		event.Reason = fmt.Sprintf("%s limit exceeded", exceeded)
+	}
+	a.server.audit(event)
+	if exceeded != "" {
+		a.exceeded(exceeded)
+	}
+	return event.Allowed
+}
+
+func (a *Auth) authenticateCertificate(username string) bool {
+	event := AuditEvent{
+		Action:     AuditConnect,
+		Username:   username,
+		RemoteAddr: a.conn.RemoteAddr().String(),
+		Listener:   a.listener,
+		Reason:     AuditNoCertificate,
+	}
+	// Both *tls.Conn and websocket connections over TLS expose their state.
+	if tlsConn, ok := a.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		certificates := tlsConn.ConnectionState().PeerCertificates
+		if len(certificates) > 0 && certificates[0].Subject.CommonName != "" {
+			commonName := certificates[0].Subject.CommonName
+			if username == "" || username == commonName {
+				event.Allowed, event.Username, event.Reason = true, commonName, ""
+			} else {
+				event.Reason = AuditCertificateOfOther
+			}
+		}
+	}
+	a.server.audit(event)
+	if !event.Allowed {
+		return false
+	}
+	a.username = event.Username
+	a.connected()
+	return true
+}
+
+// authenticateInProcess authenticates a connection opened with Dial as the
+// controller. Only brightpod itself can open one.
+func (a *Auth) authenticateInProcess() bool {
+	event := AuditEvent{
+		Action:     AuditConnect,
+		Allowed:    a.server.controller != "",
+		Username:   a.server.controller,
+		RemoteAddr: a.conn.RemoteAddr().String(),
+		Listener:   a.listener,
+	}
+	if !event.Allowed {
+		event.Reason = AuditEmptyCredentials
+	}
+	a.server.audit(event)
+	if !event.Allowed {
+		return false
+	}
+	a.username = event.Username
+	a.connected()
 	return true
 }
 
-func createAuth(authFn func(user, password []byte) bool) *Auth {
+func createAuth(server *Server, listener string, c net.Conn, packets *conn, method string) *Auth {
 	return &Auth{
-		authFn: authFn,
-		users:  cmap.New(),
+		server:   server,
+		listener: listener,
+		conn:     c,
+		packets:  packets,
+		method:   method,
+	}
+}
+
+// ParseUser splits a "user:password" credential.
+func ParseUser(credential string) (string, string, error) {
+	userPwdSplit := strings.SplitN(credential, ":", 2)
+	if len(userPwdSplit) != 2 || userPwdSplit[0] == "" || userPwdSplit[1] == "" {
+		return "", "", fmt.Errorf("cannot parse user password credential, expected user:password")
 	}
+	return userPwdSplit[0], userPwdSplit[1], nil
 }
@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// DefaultBridgeClientID is the client ID of the bridge on both brokers.
+	DefaultBridgeClientID = "brightpod-bridge"
+
+	// echoTimeout is how long a forwarded message is expected to come back
+	// from the broker it was forwarded to.
+	echoTimeout = time.Minute
+	// maxEchoes is the number of expected echoes above which the ones that
+	// never came back are dropped.
+	maxEchoes = 100
+)
+
+// BridgeOptions configures a bridge between the local broker and an upstream
+// broker, e.g. the Mosquitto of Home Assistant.
+type BridgeOptions struct {
+	Address  string `mapstructure:"address" yaml:"address"`
+	Username string `mapstructure:"username" yaml:"username,omitempty"`
+	Password string `mapstructure:"password" yaml:"password,omitempty"`
+	ClientID string `mapstructure:"client-id" yaml:"client-id,omitempty"`
+	CAFile   string `mapstructure:"ca-file" yaml:"ca-file,omitempty"`
+	CertFile string `mapstructure:"cert-file" yaml:"cert-file,omitempty"`
+	KeyFile  string `mapstructure:"key-file" yaml:"key-file,omitempty"`
+	// Out holds the topic patterns forwarded to the upstream broker.
+	Out []string `mapstructure:"out" yaml:"out,omitempty"`
+	// In holds the topic patterns forwarded from the upstream broker.
+	In  []string `mapstructure:"in" yaml:"in,omitempty"`
+	QoS byte     `mapstructure:"qos" yaml:"qos"`
+}
+
+// Validate checks the options without connecting to the upstream broker.
+func (options BridgeOptions) Validate() error {
+	if options.Address == "" {
+		return fmt.Errorf("an address is required")
+	}
+	if len(options.Out) == 0 && len(options.In) == 0 {
+		return fmt.Errorf("at least one topic pattern to forward is required")
+	}
+	for _, filter := range append(append([]string{}, options.Out...), options.In...) {
+		if err := validateFilter(filter); err != nil {
+			return err
+		}
+	}
+	if options.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2, recieved: %d", options.QoS)
+	}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return fmt.Errorf("a client certificate needs both a certificate and a key")
+	}
+	return nil
+}
+
+// BridgeEndpoint is a broker the bridge connects to.
+type BridgeEndpoint struct {
+	Address   string
+	Username  string
+	Password  string
+	ClientID  string
+	TLSConfig *tls.Config
+	// OpenConnection opens the connection instead of dialing Address when
+	// set, see Server.OpenConnection.
+	OpenConnection paho.OpenConnectionFunc
+}
+
+// Bridge forwards messages between the local broker and an upstream broker.
+// Each side reconnects on its own and subscribes again once connected.
+type Bridge struct {
+	options  BridgeOptions
+	local    paho.Client
+	upstream paho.Client
+
+	// echoes counts the messages forwarded to each side that its own
+	// subscriptions will receive back, so that they are not forwarded again.
+	lock   sync.Mutex
+	echoes map[paho.Client]map[string][]time.Time
+}
+
+// NewBridge returns a bridge forwarding the topics of the options between
+// both brokers. It does not connect until Start.
+func NewBridge(options BridgeOptions, local, upstream BridgeEndpoint) *Bridge {
+	bridge := &Bridge{
+		options: options,
+	}
+	bridge.local = paho.NewClient(bridge.clientOptions("local", local, options.Out, func() paho.Client {
+		return bridge.upstream
+	}))
+	bridge.upstream = paho.NewClient(bridge.clientOptions("upstream", upstream, options.In, func() paho.Client {
+		return bridge.local
+	}))
+	bridge.echoes = map[paho.Client]map[string][]time.Time{
+		bridge.local:    {},
+		bridge.upstream: {},
+	}
+	return bridge
+}
+
+func (bridge *Bridge) clientOptions(name string, endpoint BridgeEndpoint, filters []string, target func() paho.Client) *paho.ClientOptions {
+	clientID := endpoint.ClientID
+	if clientID == "" {
+		clientID = DefaultBridgeClientID
+	}
+
+	options := paho.NewClientOptions()
+	options.AddBroker(endpoint.Address)
+	options.SetClientID(clientID)
+	options.SetUsername(endpoint.Username)
+	options.SetPassword(endpoint.Password)
+	if endpoint.TLSConfig != nil {
+		options.SetTLSConfig(endpoint.TLSConfig)
+	}
+	options.SetCustomOpenConnectionFn(endpoint.OpenConnection)
+	options.SetConnectRetry(true)
+	options.SetAutoReconnect(true)
+	options.SetMaxReconnectInterval(time.Minute)
+	options.SetOnConnectHandler(func(c paho.Client) {
+		log.Printf("Bridge connected to the %s broker: %s", name, endpoint.Address)
+		for _, filter := range filters {
+			filter := filter
+			token := c.Subscribe(filter, bridge.options.QoS, func(c paho.Client, m paho.Message) {
+				bridge.forward(c, target(), m)
+			})
+			go func() {
+				if token.Wait(); token.Error() != nil {
+					log.Printf("Bridge could not subscribe to %s on the %s broker: %s", filter, name, token.Error())
+				}
+			}()
+		}
+	})
+	options.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Printf("Bridge lost its connection to the %s broker: %s", name, err)
+	})
+	return options
+}
+
+// Start connects to both brokers. Connecting is retried in the background
+// until Close.
+func (bridge *Bridge) Start() {
+	bridge.local.Connect()
+	bridge.upstream.Connect()
+}
+
+// Close disconnects from both brokers.
+func (bridge *Bridge) Close() {
+	bridge.local.Disconnect(250)
+	bridge.upstream.Disconnect(250)
+}
+
+// forward publishes a message received from one broker to the other, unless
+// it is the echo of a message forwarded the other way.
+func (bridge *Bridge) forward(from, to paho.Client, message paho.Message) {
+	if bridge.isEcho(from, message) {
+		return
+	}
+	if bridge.willEcho(to, message.Topic()) {
+		bridge.expectEcho(to, message)
+	}
+
+	token := to.Publish(message.Topic(), bridge.options.QoS, message.Retained(), message.Payload())
+	go func() {
+		if token.Wait(); token.Error() != nil {
+			log.Printf("Bridge could not forward %s: %s", message.Topic(), token.Error())
+		}
+	}()
+}
+
+// willEcho reports whether the subscriptions of the bridge on a broker match
+// the topic.
+func (bridge *Bridge) willEcho(client paho.Client, topic string) bool {
+	filters := bridge.options.In
+	if client == bridge.local {
+		filters = bridge.options.Out
+	}
+	for _, filter := range filters {
+		if covers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bridge *Bridge) expectEcho(client paho.Client, message paho.Message) {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+
+	now := time.Now()
+	echoes := bridge.echoes[client]
+	if len(echoes) >= maxEchoes {
+		for key, expected := range echoes {
+			if expected[len(expected)-1].Before(now) {
+				delete(echoes, key)
+			}
+		}
+	}
+	key := echoKey(message)
+	echoes[key] = append(echoes[key], now.Add(echoTimeout))
+}
+
+// isEcho consumes an echo expected from the broker, dropping the echoes that
+// never came back.
+func (bridge *Bridge) isEcho(client paho.Client, message paho.Message) bool {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+
+	key := echoKey(message)
+	now := time.Now()
+	expected := bridge.echoes[client][key]
+	for len(expected) > 0 && expected[0].Before(now) {
+		expected = expected[1:]
+	}
+	if len(expected) == 0 {
+		delete(bridge.echoes[client], key)
+		return false
+	}
+	if len(expected) == 1 {
+		delete(bridge.echoes[client], key)
+	} else {
+		bridge.echoes[client][key] = expected[1:]
+	}
+	return true
+}
+
+func echoKey(message paho.Message) string {
+	return message.Topic() + "\x00" + string(message.Payload())
+}
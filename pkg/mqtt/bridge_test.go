@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startTestServer starts a server without network listeners where the
+// clients opened with its OpenConnection have full access.
+func startTestServer(t *testing.T) *Server {
+	server := New(nil)
+	server.SetController(DefaultController)
+	server.SetACL(map[string]Rule{}, func(username string) Rule {
+		return FullAccess()
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// topicWatcher is a client of a server recording the payloads it receives
+// on each topic.
+type topicWatcher struct {
+	client   paho.Client
+	lock     sync.Mutex
+	payloads map[string][]string
+}
+
+func newTopicWatcher(t *testing.T, server *Server, filter string) *topicWatcher {
+	options := paho.NewClientOptions()
+	options.AddBroker(InProcessAddress)
+	options.SetClientID("watcher")
+	options.SetCustomOpenConnectionFn(server.OpenConnection)
+	w := &topicWatcher{client: paho.NewClient(options), payloads: map[string][]string{}}
+	if token := w.client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() {
+		w.client.Disconnect(0)
+	})
+
+	token := w.client.Subscribe(filter, 1, func(_ paho.Client, m paho.Message) {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		w.payloads[m.Topic()] = append(w.payloads[m.Topic()], string(m.Payload()))
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return w
+}
+
+func (w *topicWatcher) publish(t *testing.T, topic, payload string) {
+	if token := w.client.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+func (w *topicWatcher) received(topic string) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string{}, w.payloads[topic]...)
+}
+
+// waitFor waits until a message was received on the topic.
+func (w *topicWatcher) waitFor(t *testing.T, topic string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(w.received(topic)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("received nothing on %s", topic)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForBridge publishes to the topic from one side until the other side
+// receives it, so that both subscriptions of the bridge are in place.
+func waitForBridge(t *testing.T, from, to *topicWatcher, topic string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(to.received(topic)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the bridge did not forward %s", topic)
+		}
+		from.publish(t, topic, "ready")
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBridgeForwardsOnceWithoutEchoes(t *testing.T) {
+	localServer := startTestServer(t)
+	upstreamServer := startTestServer(t)
+	local := newTopicWatcher(t, localServer, "#")
+	upstream := newTopicWatcher(t, upstreamServer, "#")
+
+	// Both directions cover state/#, so every forwarded message comes back
+	// to the bridge from the broker it was forwarded to.
+	bridge := NewBridge(BridgeOptions{
+		Address: InProcessAddress,
+		Out:     []string{"state/#"},
+		In:      []string{"state/#"},
+		QoS:     1,
+	}, BridgeEndpoint{
+		Address:        InProcessAddress,
+		OpenConnection: localServer.OpenConnection,
+	}, BridgeEndpoint{
+		Address:        InProcessAddress,
+		OpenConnection: upstreamServer.OpenConnection,
+	})
+	bridge.Start()
+	defer bridge.Close()
+
+	waitForBridge(t, local, upstream, "state/ready/out")
+	waitForBridge(t, upstream, local, "state/ready/in")
+
+	local.publish(t, "state/fan1", "from local")
+	upstream.publish(t, "state/fan2", "from upstream")
+	upstream.waitFor(t, "state/fan1")
+	local.waitFor(t, "state/fan2")
+	// Give an echo the time to come back.
+	time.Sleep(200 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		watcher *topicWatcher
+		topic   string
+		want    string
+	}{
+		{"forwarded upstream", upstream, "state/fan1", "from local"},
+		{"published locally", local, "state/fan1", "from local"},
+		{"forwarded locally", local, "state/fan2", "from upstream"},
+		{"published upstream", upstream, "state/fan2", "from upstream"},
+	}
+	for _, tt := range tests {
+		if received := tt.watcher.received(tt.topic); len(received) != 1 || received[0] != tt.want {
+			t.Errorf("%s: received %d messages on %s, want %q once", tt.name, len(received), tt.topic, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxConnectSize bounds the bytes kept to read the CONNECT packet from.
+const maxConnectSize = 1024
+
+// publishPacket is the type of a PUBLISH packet in its fixed header.
+const publishPacket = 3
+
+// errPublishRejected is returned by a read holding a publish that was
+// rejected before its payload was read.
+var errPublishRejected = errors.New("publish rejected")
+
+// conn keeps the first bytes read from a client, which hold its CONNECT
+// packet, so that the client ID is known when it authenticates. It also
+// scans the packets read for publishes, which are checked as soon as their
+// header is read, see setPublishCheck.
+type conn struct {
+	net.Conn
+	lock  sync.Mutex
+	first []byte
+
+	// header holds the start of the packet being scanned until its topic is
+	// known, after which the rest of the packet is skipped.
+	header []byte
+	skip   int
+
+	checkPublish func(topic string, payload int) bool
+	// unchecked holds the publishes read before checkPublish was set.
+	unchecked []packetStart
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.lock.Lock()
+	if missing := maxConnectSize - len(c.first); missing > 0 && n > 0 {
+		if missing > n {
+			missing = n
+		}
+		c.first = append(c.first, p[:missing]...)
+	}
+	ok := c.scan(p[:n])
+	c.lock.Unlock()
+	if !ok {
+		return 0, errPublishRejected
+	}
+	return n, err
+}
+
+// setPublishCheck sets the function deciding whether a publish with the
+// given topic and payload size may be read. Publishes read before, such as
+// those sent along with the CONNECT packet, are checked right away. The
+// check is called with the lock held and must close the connection when it
+// rejects a publish.
+func (c *conn) setPublishCheck(check func(topic string, payload int) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checkPublish = check
+	for _, packet := range c.unchecked {
+		if !check(packet.topic, packet.payload) {
+			break
+		}
+	}
+	c.unchecked = nil
+}
+
+// scan follows the packets in the bytes read and checks every publish. It
+// returns false when a publish was rejected.
+func (c *conn) scan(p []byte) bool {
+	for len(p) > 0 {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(p) {
+				n = len(p)
+			}
+			c.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		c.header = append(c.header, p[0])
+		p = p[1:]
+		packet, ok := parsePacketStart(c.header)
+		if !ok {
+			continue
+		}
+		c.skip = packet.left
+		c.header = c.header[:0]
+		if !packet.publish {
+			continue
+		}
+		if c.checkPublish == nil {
+			c.unchecked = append(c.unchecked, packet)
+		} else if !c.checkPublish(packet.topic, packet.payload) {
+			return false
+		}
+	}
+	return true
+}
+
+type packetStart struct {
+	publish bool
+	topic   string
+	payload int
+	// left is the number of bytes of the packet after the ones parsed.
+	left int
+}
+
+// parsePacketStart reads the fixed header of a packet and, for a publish, its
+// topic. It returns false until enough bytes are known.
+func parsePacketStart(data []byte) (packetStart, bool) {
+	remaining, i := 0, 1
+	for ; ; i++ {
+		if i > 4 {
+			// A malformed length, the server drops the connection.
+			return packetStart{}, true
+		}
+		if i >= len(data) {
+			return packetStart{}, false
+		}
+		remaining |= int(data[i]&0x7f) << (7 * uint(i-1))
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+	headerSize := i + 1
+	packet := packetStart{left: remaining - (len(data) - headerSize)}
+	if data[0]>>4 != publishPacket || remaining < 2 {
+		return packet, true
+	}
+
+	if len(data) < headerSize+2 {
+		return packetStart{}, false
+	}
+	topicSize := int(binary.BigEndian.Uint16(data[headerSize:]))
+	if topicSize+2 > remaining {
+		return packet, true
+	}
+	if len(data) < headerSize+2+topicSize {
+		return packetStart{}, false
+	}
+	packet.publish = true
+	packet.topic = string(data[headerSize+2 : headerSize+2+topicSize])
+	packet.payload = remaining - 2 - topicSize
+	if qos := (data[0] >> 1) & 0x03; qos > 0 {
+		// The packet identifier.
+		packet.payload -= 2
+	}
+	packet.left = remaining - (len(data) - headerSize)
+	return packet, true
+}
+
+// clientID returns the client ID of the CONNECT packet, or an empty string
+// when it cannot be read.
+func (c *conn) clientID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return parseConnectClientID(c.first)
+}
+
+// parseConnectClientID reads the client ID of an mqtt 3.1 or 3.1.1 CONNECT
+// packet.
+func parseConnectClientID(data []byte) string {
+	if len(data) < 2 || data[0]>>4 != 1 {
+		return ""
+	}
+
+	// The remaining length takes one to four bytes.
+	i := 1
+	for ; i < len(data) && i <= 4; i++ {
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+	i++
+
+	readString := func() (string, bool) {
+		if i+2 > len(data) {
+			return "", false
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		i += 2
+		if i+length > len(data) {
+			return "", false
+		}
+		value := string(data[i : i+length])
+		i += length
+		return value, true
+	}
+
+	// Protocol name, then the level, the flags and the keepalive.
+	if _, ok := readString(); !ok {
+		return ""
+	}
+	i += 4
+	clientID, _ := readString()
+	return clientID
+}
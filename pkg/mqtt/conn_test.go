@@ -0,0 +1,222 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// remainingLength encodes the remaining length of a fixed header.
+func remainingLength(length int) []byte {
+	encoded := []byte{}
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+func mqttString(value string) []byte {
+	encoded := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(encoded, uint16(len(value)))
+	return append(encoded, value...)
+}
+
+func publishPacketBytes(topic string, qos byte, payload []byte) []byte {
+	body := mqttString(topic)
+	if qos > 0 {
+		body = append(body, 0, 1)
+	}
+	body = append(body, payload...)
+	packet := []byte{publishPacket<<4 | qos<<1}
+	packet = append(packet, remainingLength(len(body))...)
+	return append(packet, body...)
+}
+
+func connectPacketBytes(protocol string, level byte, clientID string) []byte {
+	body := mqttString(protocol)
+	body = append(body, level, 0x02, 0, 60)
+	body = append(body, mqttString(clientID)...)
+	packet := []byte{0x10}
+	packet = append(packet, remainingLength(len(body))...)
+	return append(packet, body...)
+}
+
+func TestParsePacketStart(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		ok      bool
+		publish bool
+		topic   string
+		payload int
+		left    int
+	}{
+		{name: "empty", data: []byte{}, ok: false},
+		{name: "type only", data: []byte{0x30}, ok: false},
+		{name: "ping", data: []byte{0xc0, 0x00}, ok: true, left: 0},
+		{name: "subscribe", data: []byte{0x82, 0x08}, ok: true, left: 8},
+		{name: "continued length", data: []byte{0x30, 0x80}, ok: false},
+		{name: "malformed length", data: []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, ok: true},
+		{name: "publish without topic length", data: []byte{0x30, 0x07, 0x00}, ok: false},
+		{name: "publish with partial topic", data: publishPacketBytes("state/fan1", 0, []byte("on"))[:6], ok: false},
+		{
+			name: "publish", data: publishPacketBytes("state/fan1", 0, []byte("on"))[:14],
+			ok: true, publish: true, topic: "state/fan1", payload: 2, left: 2,
+		},
+		{
+			name: "publish with packet identifier", data: publishPacketBytes("a", 1, []byte("hello"))[:5],
+			ok: true, publish: true, topic: "a", payload: 5, left: 7,
+		},
+		{
+			name: "publish with a two byte length", data: publishPacketBytes("a/b", 0, long)[:8],
+			ok: true, publish: true, topic: "a/b", payload: 300, left: 300,
+		},
+		{name: "topic longer than the packet", data: []byte{0x30, 0x03, 0x00, 0x09, 'a'}, ok: true, left: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, ok := parsePacketStart(tt.data)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if packet.publish != tt.publish || packet.topic != tt.topic || packet.payload != tt.payload {
+				t.Errorf("packet = %+v, want publish %v to %q with %d bytes", packet, tt.publish, tt.topic, tt.payload)
+			}
+			if packet.left != tt.left {
+				t.Errorf("left = %d, want %d", packet.left, tt.left)
+			}
+		})
+	}
+}
+
+func TestParseConnectClientID(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"mqtt 3.1.1", connectPacketBytes("MQTT", 4, "livingroom"), "livingroom"},
+		{"mqtt 3.1", connectPacketBytes("MQIsdp", 3, "livingroom"), "livingroom"},
+		{"empty client id", connectPacketBytes("MQTT", 4, ""), ""},
+		{"long client id", connectPacketBytes("MQTT", 4, string(bytes.Repeat([]byte("c"), 200))), string(bytes.Repeat([]byte("c"), 200))},
+		{"truncated", connectPacketBytes("MQTT", 4, "livingroom")[:16], ""},
+		{"not a connect", publishPacketBytes("a", 0, []byte("b")), ""},
+		{"too short", []byte{0x10}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := parseConnectClientID(tt.data); got != tt.want {
+			t.Errorf("%s: client id = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+type checkedPublish struct {
+	topic   string
+	payload int
+}
+
+// scanInChunks feeds the stream to a conn in chunks of the given size and
+// returns the publishes it checked.
+func scanInChunks(t *testing.T, stream []byte, size int) []checkedPublish {
+	c := newConn(nil)
+	checked := []checkedPublish{}
+	c.setPublishCheck(func(topic string, payload int) bool {
+		checked = append(checked, checkedPublish{topic, payload})
+		return true
+	})
+	for len(stream) > 0 {
+		n := size
+		if n > len(stream) {
+			n = len(stream)
+		}
+		if !c.scan(stream[:n]) {
+			t.Fatalf("scan rejected a publish")
+		}
+		stream = stream[n:]
+	}
+	if c.skip != 0 || len(c.header) != 0 {
+		t.Errorf("stream ended in the middle of a packet: skip %d, header %v", c.skip, c.header)
+	}
+	return checked
+}
+
+func TestConnScan(t *testing.T) {
+	stream := connectPacketBytes("MQTT", 4, "fan1")
+	stream = append(stream, publishPacketBytes("fan1/keep_alive", 1, []byte(`{"v":1}`))...)
+	stream = append(stream, 0xc0, 0x00)
+	stream = append(stream, publishPacketBytes("$SYS/broker", 0, nil)...)
+	stream = append(stream, publishPacketBytes("state/fan1", 0, bytes.Repeat([]byte("x"), 1000))...)
+	want := []checkedPublish{{"fan1/keep_alive", 7}, {"$SYS/broker", 0}, {"state/fan1", 1000}}
+
+	for _, size := range []int{1, 2, 3, 7, 64, len(stream)} {
+		checked := scanInChunks(t, stream, size)
+		if len(checked) != len(want) {
+			t.Fatalf("chunks of %d: checked %+v, want %+v", size, checked, want)
+		}
+		for i := range want {
+			if checked[i] != want[i] {
+				t.Errorf("chunks of %d: publish %d is %+v, want %+v", size, i, checked[i], want[i])
+			}
+		}
+	}
+}
+
+func TestConnChecksPublishesReadBeforeAuthentication(t *testing.T) {
+	c := newConn(nil)
+	stream := connectPacketBytes("MQTT", 4, "fan1")
+	stream = append(stream, publishPacketBytes("a", 0, []byte("early"))...)
+	c.scan(stream)
+
+	checked := []checkedPublish{}
+	c.setPublishCheck(func(topic string, payload int) bool {
+		checked = append(checked, checkedPublish{topic, payload})
+		return true
+	})
+	if len(checked) != 1 || checked[0] != (checkedPublish{"a", 5}) {
+		t.Errorf("checked %+v, want the publish sent with the CONNECT packet", checked)
+	}
+}
+
+func TestConnReadRejectsPublish(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConn(server)
+	c.setPublishCheck(func(topic string, payload int) bool {
+		if payload > 4 {
+			server.Close()
+			return false
+		}
+		return true
+	})
+
+	allowed := publishPacketBytes("a", 0, []byte("ok"))
+	go func() {
+		client.Write(allowed)
+		client.Write(publishPacketBytes("a", 0, []byte("too long")))
+	}()
+
+	buf := make([]byte, 64)
+	if n, err := io.ReadFull(c, buf[:len(allowed)]); err != nil {
+		t.Fatalf("read %d bytes of the allowed publish: %v", n, err)
+	}
+	n, err := c.Read(buf)
+	if err != errPublishRejected || n != 0 {
+		t.Errorf("read %d bytes, %v, want the publish rejected", n, err)
+	}
+}
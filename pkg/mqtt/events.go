@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	ReasonClientDisconnected = "client disconnected"
+	ReasonConnectionClosed   = "connection closed"
+	ReasonTimeout            = "keepalive timeout"
+	ReasonTakenOver          = "session taken over"
+	ReasonUserDeleted        = "user deleted"
+	ReasonLimitExceeded      = "limit exceeded"
+)
+
+// ConnectionEvent tells that an authenticated client connected to the server
+// or that its connection ended.
+type ConnectionEvent struct {
+	Connected  bool      `json:"connected"`
+	ClientID   string    `json:"client_id"`
+	Username   string    `json:"username"`
+	RemoteAddr string    `json:"remote_addr"`
+	Listener   string    `json:"listener"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// SetConnectionHandler sets a function called with every connection event.
+// It must be called before Start.
+func (server *Server) SetConnectionHandler(handler func(event ConnectionEvent)) {
+	server.onConnection = handler
+}
+
+func (server *Server) connectionEvent(a *Auth, connected bool, reason string) {
+	if server.onConnection == nil {
+		return
+	}
+	server.onConnection(ConnectionEvent{
+		Connected:  connected,
+		ClientID:   a.clientID,
+		Username:   a.username,
+		RemoteAddr: a.conn.RemoteAddr().String(),
+		Listener:   a.listener,
+		Reason:     reason,
+		Time:       time.Now(),
+	})
+}
+
+// disconnectReason describes why the connection of a client ended from the
+// error it ended with.
+func disconnectReason(a *Auth, err error) string {
+	var netErr net.Error
+	switch {
+	case a.closeReason() != "":
+		return a.closeReason()
+	case err == nil:
+		return ReasonClientDisconnected
+	case errors.Is(err, io.EOF):
+		return ReasonConnectionClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// ListenerInProcess is the id of the listener serving Dial.
+	ListenerInProcess = "inprocess"
+	// InProcessAddress is the broker URL of clients connecting with Dial,
+	// it is never dialed.
+	InProcessAddress = "tcp://inprocess"
+	// DefaultController is the user of the clients connecting with Dial
+	// when none is set.
+	DefaultController = "brightpod"
+)
+
+// pipeListener accepts the connections opened with Dial as a net.Listener.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// dial returns the client end of a new connection.
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("mqtt server is closed")
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("in-process listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return ListenerInProcess }
+
+// SetController sets the user of the clients connecting with Dial, which do
+// not send a password. It must be called before Start.
+func (server *Server) SetController(username string) {
+	server.controller = username
+}
+
+// Dial opens a connection to the server without going through the network.
+// It waits for the server to serve and fails after Close.
+func (server *Server) Dial() (net.Conn, error) {
+	return server.inProcess.dial()
+}
+
+// OpenConnection connects paho clients with Dial, whatever their broker URL,
+// see paho.ClientOptions.SetCustomOpenConnectionFn.
+func (server *Server) OpenConnection(uri *url.URL, options paho.ClientOptions) (net.Conn, error) {
+	return server.Dial()
+}
@@ -0,0 +1,213 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+const (
+	DropRate          = "rate"
+	DropPayload       = "payload"
+	DropSubscriptions = "subscriptions"
+)
+
+// Limits restricts what the clients of a user may send to the server. A
+// zero value means no limit.
+type Limits struct {
+	// MessagesPerSecond is shared by every connection of the user, which may
+	// send up to a second worth of messages at once.
+	MessagesPerSecond float64 `mapstructure:"messages-per-second" yaml:"messages-per-second,omitempty"`
+	// MaxPayload is the size in bytes of the largest message payload. A
+	// larger publish always closes the connection, as it is rejected before
+	// its payload is read.
+	MaxPayload int `mapstructure:"max-payload" yaml:"max-payload,omitempty"`
+	// MaxSubscriptions is the number of topic filters of a connection.
+	MaxSubscriptions int `mapstructure:"max-subscriptions" yaml:"max-subscriptions,omitempty"`
+	// Disconnect closes the connection of a client exceeding a limit instead
+	// of only dropping its message or subscription.
+	Disconnect bool `mapstructure:"disconnect" yaml:"disconnect,omitempty"`
+}
+
+// Validate checks that no limit is negative.
+func (limits Limits) Validate() error {
+	if limits.MessagesPerSecond < 0 || limits.MaxPayload < 0 || limits.MaxSubscriptions < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	return nil
+}
+
+// bucket is a token bucket refilled at the rate of messages per second.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter applies the limits of every user and counts what they dropped.
+type limiter struct {
+	lock          sync.Mutex
+	limits        map[string]Limits
+	defaultLimits func(username string) Limits
+	buckets       map[string]*bucket
+	dropped       map[string]map[string]int64
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		limits: map[string]Limits{},
+		defaultLimits: func(username string) Limits {
+			return Limits{}
+		},
+		buckets: map[string]*bucket{},
+		dropped: map[string]map[string]int64{},
+	}
+}
+
+func (l *limiter) get(username string) Limits {
+	if limits, ok := l.limits[username]; ok {
+		return limits
+	}
+	return l.defaultLimits(username)
+}
+
+// allowMessage takes a token from the bucket of the user.
+func (l *limiter) allowMessage(username string, limits Limits) bool {
+	if limits.MessagesPerSecond <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	burst := limits.MessagesPerSecond
+	if burst < 1 {
+		burst = 1
+	}
+	b, ok := l.buckets[username]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[username] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limits.MessagesPerSecond
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *limiter) drop(username, reason string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.dropped[username] == nil {
+		l.dropped[username] = map[string]int64{}
+	}
+	l.dropped[username][reason]++
+}
+
+// SetLimits replaces the limits of every user. Users without limits get the
+// ones returned by defaultLimits.
+func (server *Server) SetLimits(limits map[string]Limits, defaultLimits func(username string) Limits) {
+	server.limiter.lock.Lock()
+	defer server.limiter.lock.Unlock()
+	server.limiter.limits = limits
+	server.limiter.defaultLimits = defaultLimits
+	server.limiter.buckets = map[string]*bucket{}
+}
+
+func (server *Server) limits(username string) Limits {
+	server.limiter.lock.Lock()
+	defer server.limiter.lock.Unlock()
+	return server.limiter.get(username)
+}
+
+// Dropped returns the number of messages and subscriptions dropped for each
+// user, by the limit they exceeded.
+func (server *Server) Dropped() map[string]map[string]int64 {
+	server.limiter.lock.Lock()
+	defer server.limiter.lock.Unlock()
+
+	dropped := map[string]map[string]int64{}
+	for username, counts := range server.limiter.dropped {
+		dropped[username] = map[string]int64{}
+		for reason, count := range counts {
+			dropped[username][reason] = count
+		}
+	}
+	return dropped
+}
+
+// checkLimits returns the limit a publish or a subscription of the client
+// exceeds, or an empty string.
+func (a *Auth) checkLimits(topic string, write bool) string {
+	limits := a.server.limits(a.username)
+	if write {
+		if !a.server.limiter.allowMessage(a.username, limits) {
+			return DropRate
+		}
+		return ""
+	}
+	if limits.MaxSubscriptions > 0 && a.server.subscriptions(a, topic) >= limits.MaxSubscriptions {
+		return DropSubscriptions
+	}
+	return ""
+}
+
+// checkPayload is the publish check of the connection. It closes the
+// connection of a client publishing a payload over the limit of its user.
+func (a *Auth) checkPayload(topic string, size int) bool {
+	limits := a.server.limits(a.username)
+	if limits.MaxPayload <= 0 || size <= limits.MaxPayload {
+		return true
+	}
+	a.server.audit(AuditEvent{
+		Action:     AuditPublish,
+		Username:   a.username,
+		RemoteAddr: a.conn.RemoteAddr().String(),
+		Listener:   a.listener,
+		Topic:      topic,
+		Reason:     fmt.Sprintf("%s limit exceeded", DropPayload),
+	})
+	a.server.limiter.drop(a.username, DropPayload)
+	log.Printf("Disconnecting client %s of %s over the %s limit", a.clientID, a.username, DropPayload)
+	a.close(ReasonLimitExceeded)
+	return false
+}
+
+// exceeded counts a message or a subscription dropped by a limit and closes
+// the connection when the limits of the user say so.
+func (a *Auth) exceeded(reason string) {
+	a.server.limiter.drop(a.username, reason)
+	if a.server.limits(a.username).Disconnect {
+		log.Printf("Disconnecting client %s of %s over the %s limit", a.clientID, a.username, reason)
+		a.close(ReasonLimitExceeded)
+	}
+}
+
+// subscriptions returns the number of topic filters of the client, other
+// than the given one.
+func (server *Server) subscriptions(a *Auth, filter string) int {
+	if server.broker == nil {
+		return 0
+	}
+	for _, cl := range server.broker.Clients.GetByListener(a.listener) {
+		if cl.AC != auth.Controller(a) {
+			continue
+		}
+		cl.RLock()
+		defer cl.RUnlock()
+		count := len(cl.Subscriptions)
+		if _, ok := cl.Subscriptions[filter]; ok {
+			count--
+		}
+		return count
+	}
+	return 0
+}
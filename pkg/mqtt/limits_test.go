@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowMessage(t *testing.T) {
+	l := newLimiter()
+	limits := Limits{MessagesPerSecond: 2}
+
+	for i := 0; i < 2; i++ {
+		if !l.allowMessage("fan1", limits) {
+			t.Fatalf("message %d within the burst was not allowed", i+1)
+		}
+	}
+	if l.allowMessage("fan1", limits) {
+		t.Errorf("message over the burst was allowed")
+	}
+	if !l.allowMessage("fan2", limits) {
+		t.Errorf("another user shares the bucket of fan1")
+	}
+
+	// Refill the bucket of fan1 by half a second, one message at 2 per second.
+	l.buckets["fan1"].last = l.buckets["fan1"].last.Add(-500 * time.Millisecond)
+	if !l.allowMessage("fan1", limits) {
+		t.Errorf("message was not allowed after the bucket refilled")
+	}
+	if l.allowMessage("fan1", limits) {
+		t.Errorf("the bucket refilled by more than the elapsed time")
+	}
+
+	// The bucket never holds more than a second worth of messages.
+	l.buckets["fan1"].last = l.buckets["fan1"].last.Add(-time.Hour)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.allowMessage("fan1", limits) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d messages after an hour, want the burst of 2", allowed)
+	}
+}
+
+func TestAllowMessageBelowOnePerSecond(t *testing.T) {
+	l := newLimiter()
+	limits := Limits{MessagesPerSecond: 0.5}
+
+	if !l.allowMessage("fan1", limits) {
+		t.Fatalf("the first message was not allowed")
+	}
+	if l.allowMessage("fan1", limits) {
+		t.Errorf("a second message was allowed right away")
+	}
+	l.buckets["fan1"].last = l.buckets["fan1"].last.Add(-2 * time.Second)
+	if !l.allowMessage("fan1", limits) {
+		t.Errorf("message was not allowed after two seconds")
+	}
+}
+
+func TestAllowMessageWithoutLimit(t *testing.T) {
+	l := newLimiter()
+	for i := 0; i < 100; i++ {
+		if !l.allowMessage("fan1", Limits{}) {
+			t.Fatalf("message %d was not allowed without a limit", i+1)
+		}
+	}
+	if len(l.buckets) != 0 {
+		t.Errorf("a bucket was created without a limit")
+	}
+}
+
+func TestLimitsValidate(t *testing.T) {
+	valid := []Limits{{}, {MessagesPerSecond: 0.5, MaxPayload: 1024, MaxSubscriptions: 10}}
+	for _, limits := range valid {
+		if err := limits.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %s", limits, err)
+		}
+	}
+	invalid := []Limits{{MessagesPerSecond: -1}, {MaxPayload: -1}, {MaxSubscriptions: -1}}
+	for _, limits := range invalid {
+		if err := limits.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", limits)
+		}
+	}
+}
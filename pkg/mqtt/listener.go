@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// listener serves the connections of a net.Listener through serveConn, which
+// gives each one its own auth controller so that authentication and topic
+// rules can depend on the connection, such as on the certificate a client
+// presented.
+type listener struct {
+	sync.RWMutex
+	id        string
+	listen    func() (net.Listener, error)
+	serveConn func(id string, conn net.Conn, establish listeners.EstablishFunc)
+	ln        net.Listener
+	end       int64
+}
+
+func newListener(id string, listen func() (net.Listener, error), serveConn func(id string, conn net.Conn, establish listeners.EstablishFunc)) *listener {
+	return &listener{
+		id:        id,
+		listen:    listen,
+		serveConn: serveConn,
+	}
+}
+
+// SetConfig is a no-op, the auth controller of every connection comes from
+// serveConn.
+func (l *listener) SetConfig(config *listeners.Config) {}
+
+func (l *listener) ID() string {
+	return l.id
+}
+
+func (l *listener) Listen(s *system.Info) error {
+	ln, err := l.listen()
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	l.ln = ln
+	l.Unlock()
+	return nil
+}
+
+func (l *listener) Serve(establish listeners.EstablishFunc) {
+	l.RLock()
+	ln := l.ln
+	l.RUnlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil || atomic.LoadInt64(&l.end) == 1 {
+			return
+		}
+		go l.serveConn(l.id, conn, establish)
+	}
+}
+
+func (l *listener) Close(closeClients listeners.CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapInt64(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+	if l.ln != nil {
+		l.ln.Close()
+	}
+}
+
+const (
+	ListenerTCP       = "tcp"
+	ListenerTLS       = "tls"
+	ListenerWebsocket = "websocket"
+	ListenerSysInfo   = "sysinfo"
+
+	// AuthPassword checks the username and password against the users.
+	AuthPassword = "password"
+	// AuthCertificate maps the common name of the client certificate to
+	// the user instead of checking a password.
+	AuthCertificate = "certificate"
+	// AuthNone is only allowed for sysinfo listeners.
+	AuthNone = "none"
+
+	// authInProcess authenticates the connections opened with Dial as the
+	// controller.
+	authInProcess = "inprocess"
+)
+
+// ListenerOptions configures one listener of the server.
+type ListenerOptions struct {
+	// Type is one of tcp, tls, websocket or sysinfo.
+	Type string `mapstructure:"type" yaml:"type"`
+	// Address is the address to bind to, e.g. :1883.
+	Address string `mapstructure:"address" yaml:"address"`
+	// TLS is required for tls listeners and optional for the others.
+	TLS *TLSOptions `mapstructure:"tls" yaml:"tls,omitempty"`
+	// Auth is one of password, certificate or none, defaults to password.
+	Auth string `mapstructure:"auth" yaml:"auth,omitempty"`
+}
+
+// DefaultListeners returns the plain tcp listener on port 1883.
+func DefaultListeners() []ListenerOptions {
+	return []ListenerOptions{
+		{Type: ListenerTCP, Address: ":1883", Auth: AuthPassword},
+	}
+}
+
+// Validate checks the options and loads the TLS certificates.
+func (options ListenerOptions) Validate() error {
+	switch options.Type {
+	case ListenerTCP, ListenerTLS, ListenerWebsocket, ListenerSysInfo:
+	default:
+		return fmt.Errorf("unknown listener type %q, expected one of tcp, tls, websocket or sysinfo", options.Type)
+	}
+	if options.Address == "" {
+		return fmt.Errorf("%s listener does not have an address", options.Type)
+	}
+	if options.Type == ListenerTLS && options.TLS == nil {
+		return fmt.Errorf("tls listener on %s does not have tls settings", options.Address)
+	}
+
+	switch options.auth() {
+	case AuthPassword:
+	case AuthCertificate:
+		if options.TLS == nil || options.TLS.CAFile == "" {
+			return fmt.Errorf("listener on %s needs tls with a ca to verify client certificates", options.Address)
+		}
+		if options.Type == ListenerSysInfo {
+			return fmt.Errorf("sysinfo listener on %s only supports password or none auth", options.Address)
+		}
+	case AuthNone:
+		if options.Type != ListenerSysInfo {
+			return fmt.Errorf("listener on %s cannot disable auth, only sysinfo listeners can", options.Address)
+		}
+	default:
+		return fmt.Errorf("unknown auth %q on listener %s, expected one of password, certificate or none", options.Auth, options.Address)
+	}
+
+	if options.TLS != nil {
+		if _, err := options.TLS.Config(false); err != nil {
+			return fmt.Errorf("listener on %s: %w", options.Address, err)
+		}
+	}
+	return nil
+}
+
+func (options ListenerOptions) auth() string {
+	if options.Auth == "" {
+		return AuthPassword
+	}
+	return options.Auth
+}
+
+func (options ListenerOptions) tlsConfig() (*tls.Config, error) {
+	if options.TLS == nil {
+		return nil, nil
+	}
+	return options.TLS.Config(options.auth() == AuthCertificate)
+}
+
+// newServerListener creates the listener for the options, authenticating
+// its clients against the server.
+func newServerListener(server *Server, sysInfo func() *system.Info, id string, options ListenerOptions) (listeners.Listener, error) {
+	config, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	serveConn := func(id string, conn net.Conn, establish listeners.EstablishFunc) {
+		server.serveConn(id, conn, options.auth(), establish)
+	}
+
+	switch options.Type {
+	case ListenerTCP, ListenerTLS:
+		return newListener(id, func() (net.Listener, error) {
+			if config != nil {
+				return tls.Listen("tcp", options.Address, config)
+			}
+			return net.Listen("tcp", options.Address)
+		}, serveConn), nil
+	case ListenerWebsocket:
+		return newListener(id, func() (net.Listener, error) {
+			return listenWebsocket(options.Address, config)
+		}, serveConn), nil
+	case ListenerSysInfo:
+		sysInfo := &sysInfoListener{
+			id:      id,
+			address: options.Address,
+			config:  config,
+			info:    sysInfo,
+		}
+		if options.auth() != AuthNone {
+			sysInfo.auth = func(username, password, remoteAddr string) bool {
+				return server.login(id, remoteAddr, username, password, false)
+			}
+		}
+		return sysInfo, nil
+	}
+	return nil, fmt.Errorf("unknown listener type: %s", options.Type)
+}
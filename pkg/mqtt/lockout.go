@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LockoutUser    = "user"
+	LockoutAddress = "address"
+)
+
+// maxTrackedFailures is the number of users and addresses with failed logins
+// above which the ones outside of the window are forgotten.
+const maxTrackedFailures = 1000
+
+// LockoutOptions configures how failed logins lock out a username at a client
+// address, or the address as a whole. MaxFailures failures within Window lock
+// it out for Duration. Lockouts are disabled when MaxFailures is 0.
+type LockoutOptions struct {
+	MaxFailures int
+	Window      time.Duration
+	Duration    time.Duration
+}
+
+// Lockout is a client address, or a username at a client address, that
+// cannot log in until the given time.
+type Lockout struct {
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Address  string    `json:"address"`
+	Until    time.Time `json:"until"`
+}
+
+type lockoutKey struct {
+	kind     string
+	username string
+	address  string
+}
+
+func (key lockoutKey) String() string {
+	if key.kind == LockoutUser {
+		return "user " + key.username + " at " + key.address
+	}
+	return "address " + key.address
+}
+
+// lockouts counts the failed logins of every username and client address.
+type lockouts struct {
+	lock     sync.Mutex
+	options  LockoutOptions
+	failures map[lockoutKey][]time.Time
+	locked   map[lockoutKey]time.Time
+}
+
+func newLockouts() *lockouts {
+	return &lockouts{
+		failures: map[lockoutKey][]time.Time{},
+		locked:   map[lockoutKey]time.Time{},
+	}
+}
+
+func (l *lockouts) setOptions(options LockoutOptions) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.options = options
+}
+
+// lockoutKeys returns the keys a login counts towards. Usernames are only
+// locked out at the address that failed, so that no other host can lock out
+// a user. Loopback addresses are never locked out as a whole, brightpod
+// itself connects from them.
+func lockoutKeys(username, host string) []lockoutKey {
+	keys := []lockoutKey{}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		keys = append(keys, lockoutKey{kind: LockoutAddress, address: host})
+	}
+	if username != "" {
+		keys = append(keys, lockoutKey{kind: LockoutUser, username: username, address: host})
+	}
+	return keys
+}
+
+// isLocked reports whether the username at the address, or the address, is
+// locked out.
+func (l *lockouts) isLocked(username, host string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range lockoutKeys(username, host) {
+		if until, ok := l.locked[key]; ok {
+			if now.Before(until) {
+				return true
+			}
+			delete(l.locked, key)
+		}
+	}
+	return false
+}
+
+// fail records a failed login and locks out the username at the address, and
+// the address, once they failed too often.
+func (l *lockouts) fail(username, host string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.options.MaxFailures <= 0 {
+		return
+	}
+
+	now := time.Now()
+	since := now.Add(-l.options.Window)
+	if len(l.failures) >= maxTrackedFailures {
+		for key, times := range l.failures {
+			if times[len(times)-1].Before(since) {
+				delete(l.failures, key)
+			}
+		}
+	}
+	for _, key := range lockoutKeys(username, host) {
+		times := append(l.failures[key], now)
+		for len(times) > 0 && times[0].Before(since) {
+			times = times[1:]
+		}
+		if len(times) < l.options.MaxFailures {
+			l.failures[key] = times
+			continue
+		}
+		delete(l.failures, key)
+		l.locked[key] = now.Add(l.options.Duration)
+		log.Printf("Locked out %s until %s after %d failed logins", key, l.locked[key].Format(time.RFC3339), len(times))
+	}
+}
+
+// succeed forgets the failed logins of a username at an address.
+func (l *lockouts) succeed(username, host string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, lockoutKey{kind: LockoutUser, username: username, address: host})
+}
+
+func (l *lockouts) list() []Lockout {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	list := []Lockout{}
+	for key, until := range l.locked {
+		if !now.Before(until) {
+			delete(l.locked, key)
+			continue
+		}
+		list = append(list, Lockout{Type: key.kind, Username: key.username, Address: key.address, Until: until})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+	return list
+}
+
+// SetLockout sets how failed logins lock out usernames and addresses.
+func (server *Server) SetLockout(options LockoutOptions) {
+	server.lockouts.setOptions(options)
+}
+
+// Lockouts returns the usernames and addresses currently locked out.
+func (server *Server) Lockouts() []Lockout {
+	return server.lockouts.list()
+}
+
+// remoteHost returns the host of a remote address, without its port.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
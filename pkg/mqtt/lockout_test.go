@@ -0,0 +1,127 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLockouts(maxFailures int, window, duration time.Duration) *lockouts {
+	l := newLockouts()
+	l.setOptions(LockoutOptions{MaxFailures: maxFailures, Window: window, Duration: duration})
+	return l
+}
+
+func TestLockoutAfterMaxFailures(t *testing.T) {
+	l := newTestLockouts(3, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		l.fail("fan1", "10.0.0.1")
+	}
+	if l.isLocked("fan1", "10.0.0.1") {
+		t.Fatalf("locked out before the maximum number of failures")
+	}
+	l.fail("fan1", "10.0.0.1")
+	if !l.isLocked("fan1", "10.0.0.1") {
+		t.Fatalf("not locked out after the maximum number of failures")
+	}
+	if !l.isLocked("fan2", "10.0.0.1") {
+		t.Errorf("the address that failed is not locked out for other users")
+	}
+	if l.isLocked("fan1", "10.0.0.2") {
+		t.Errorf("the user is locked out at another address")
+	}
+
+	list := l.list()
+	if len(list) != 2 {
+		t.Fatalf("lockouts = %+v, want the address and the user at the address", list)
+	}
+	for _, lockout := range list {
+		if lockout.Address != "10.0.0.1" {
+			t.Errorf("lockout of %s, want 10.0.0.1", lockout.Address)
+		}
+		if lockout.Type == LockoutUser && lockout.Username != "fan1" {
+			t.Errorf("user lockout of %s, want fan1", lockout.Username)
+		}
+	}
+}
+
+func TestLockoutDoesNotSpreadAcrossAddresses(t *testing.T) {
+	l := newTestLockouts(3, time.Minute, time.Minute)
+
+	// An attacker guessing the password of a known user from several hosts
+	// only locks out those hosts.
+	for _, host := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		l.fail("fan1", host)
+		l.fail("fan1", host)
+	}
+	if l.isLocked("fan1", "10.0.0.4") {
+		t.Errorf("user is locked out at an address that never failed")
+	}
+}
+
+func TestLockoutLoopback(t *testing.T) {
+	l := newTestLockouts(2, time.Minute, time.Minute)
+
+	l.fail("fan1", "127.0.0.1")
+	l.fail("fan2", "127.0.0.1")
+	if l.isLocked("brightpod", "127.0.0.1") {
+		t.Errorf("a loopback address was locked out as a whole")
+	}
+	l.fail("fan1", "127.0.0.1")
+	if !l.isLocked("fan1", "127.0.0.1") {
+		t.Errorf("a user at a loopback address was not locked out")
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	l := newTestLockouts(2, 20*time.Millisecond, time.Minute)
+
+	l.fail("fan1", "10.0.0.1")
+	time.Sleep(30 * time.Millisecond)
+	l.fail("fan1", "10.0.0.1")
+	if l.isLocked("fan1", "10.0.0.1") {
+		t.Errorf("failures outside of the window counted towards a lockout")
+	}
+	l.fail("fan1", "10.0.0.1")
+	if !l.isLocked("fan1", "10.0.0.1") {
+		t.Errorf("failures within the window did not lock out")
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	l := newTestLockouts(1, time.Minute, 20*time.Millisecond)
+
+	l.fail("fan1", "10.0.0.1")
+	if !l.isLocked("fan1", "10.0.0.1") {
+		t.Fatalf("not locked out")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if l.isLocked("fan1", "10.0.0.1") {
+		t.Errorf("still locked out after the duration")
+	}
+	if list := l.list(); len(list) != 0 {
+		t.Errorf("expired lockouts are listed: %+v", list)
+	}
+}
+
+func TestLockoutSucceedForgetsFailures(t *testing.T) {
+	l := newTestLockouts(2, time.Minute, time.Minute)
+
+	l.fail("fan1", "127.0.0.1")
+	l.succeed("fan1", "127.0.0.1")
+	l.fail("fan1", "127.0.0.1")
+	if l.isLocked("fan1", "127.0.0.1") {
+		t.Errorf("failures before a successful login counted towards a lockout")
+	}
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	l := newTestLockouts(0, time.Minute, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		l.fail("fan1", "10.0.0.1")
+	}
+	if l.isLocked("fan1", "10.0.0.1") {
+		t.Errorf("locked out with lockouts disabled")
+	}
+}
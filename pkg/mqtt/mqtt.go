@@ -3,24 +3,52 @@ package mqtt
 import (
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"net"
+	"sync"
 
 	mqtt "github.com/mochi-co/mqtt/server"
 	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/persistence"
+	"github.com/mochi-co/mqtt/server/system"
 	cmap "github.com/orcaman/concurrent-map"
 )
 
 type Server struct {
-	brokerPort int
-	users      cmap.ConcurrentMap
+	listeners []ListenerOptions
+	users     cmap.ConcurrentMap
+
+	aclLock     sync.RWMutex
+	rules       map[string]Rule
+	defaultRule func(username string) Rule
+
+	store    persistence.Store
+	sessions *sessions
+
+	unknownUser  func(username, password string) bool
+	onConnection func(event ConnectionEvent)
+	onAudit      func(event AuditEvent)
+	lockouts     *lockouts
+	limiter      *limiter
+	broker       *mqtt.Server
+
+	// controller is the user of the connections opened with Dial.
+	controller string
+	inProcess  *pipeListener
 }
 
-func New(port int) Server {
-	server := Server{
-		brokerPort: port,
-		users:      cmap.New(),
+// New returns a server with the given listeners, see DefaultListeners.
+func New(listeners []ListenerOptions) *Server {
+	server := &Server{
+		listeners: listeners,
+		users:     cmap.New(),
+		rules:     map[string]Rule{},
+		sessions:  newSessions(),
+		lockouts:  newLockouts(),
+		limiter:   newLimiter(),
+		inProcess: newPipeListener(),
+		defaultRule: func(username string) Rule {
+			return Rule{}
+		},
 	}
 	return server
 }
@@ -30,44 +58,203 @@ func (server *Server) ConfigureUser(username string, password string) {
 	log.Printf("Added new user: %s", username)
 }
 
-func (server *Server) Start() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	tcp := listeners.NewTCP("tcpbroker", fmt.Sprintf(":%d", server.brokerPort))
-	mqttServer := mqtt.New()
+// DeleteUser removes a user and closes its connections. It returns false
+// when there is no such user.
+func (server *Server) DeleteUser(username string) bool {
+	if _, ok := server.users.Get(username); !ok {
+		return false
+	}
+	server.users.Remove(username)
+	log.Printf("Removed user: %s", username)
+	if count := server.sessions.disconnect(username); count > 0 {
+		log.Printf("Disconnected %d sessions of user %s", count, username)
+	}
+	return true
+}
 
-	authHandler := createAuth(func(user, passwordByte []byte) bool {
-		username := string(user)
-		password := string(passwordByte)
+// Users returns the names of the users that can access the server.
+func (server *Server) Users() []string {
+	return server.users.Keys()
+}
 
-		if len(username) == 0 || len(password) == 0 {
-			log.Printf("Rejecting connection with empty username or password")
-			return false
+// SetUsers replaces the users that can access the server. Users that are kept
+// or added do not lose their connection, removed users cannot connect again.
+func (server *Server) SetUsers(users map[string]string) {
+	for username, password := range users {
+		if storedPwd, ok := server.users.Get(username); !ok || storedPwd != password {
+			server.ConfigureUser(username, password)
 		}
+	}
 
-		if storedPwd, ok := server.users.Get(username); ok {
-			if password == storedPwd {
-				log.Printf("Authenticated a user: %s", username)
-				return true
-			} else {
-				log.Printf("Password for user %s did not match.", username)
-			}
+	for _, username := range server.users.Keys() {
+		if _, ok := users[username]; !ok {
+			server.users.Remove(username)
+			log.Printf("Removed user: %s", username)
 		}
-		log.Printf("No user with name: %s", username)
-		return false
+	}
+}
+
+// SetACL replaces the topic rules of the users. Users without a rule of their
+// own get the one returned by defaultRule. Rules apply to every publish and
+// subscribe after the call, including those of connected users.
+func (server *Server) SetACL(rules map[string]Rule, defaultRule func(username string) Rule) {
+	server.aclLock.Lock()
+	defer server.aclLock.Unlock()
+	server.rules = rules
+	server.defaultRule = defaultRule
+}
+
+func (server *Server) rule(username string) Rule {
+	server.aclLock.RLock()
+	defer server.aclLock.RUnlock()
+	if rule, ok := server.rules[username]; ok {
+		return rule
+	}
+	return server.defaultRule(username)
+}
+
+// SetUnknownUserHandler sets a handler deciding whether a user that does not
+// exist may connect, e.g. to pair new devices. It must be called before
+// Start.
+func (server *Server) SetUnknownUserHandler(handler func(username, password string) bool) {
+	server.unknownUser = handler
+}
+
+// SetStore makes the server keep retained messages, subscriptions, sessions
+// and inflight messages in the store across restarts. It must be called
+// before Start.
+func (server *Server) SetStore(store persistence.Store) {
+	server.store = store
+}
+
+// login authenticates a client of a listener, auditing the decision and
+// counting the failures towards a lockout. Only mqtt clients may pair, other
+// listeners only let existing users in.
+func (server *Server) login(listener, remoteAddr, username, password string, pair bool) bool {
+	host := remoteHost(remoteAddr)
+	ok, reason := server.authenticate(username, password, host, pair)
+	server.audit(AuditEvent{
+		Action:     AuditConnect,
+		Allowed:    ok,
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		Listener:   listener,
+		Reason:     reason,
 	})
+	if ok {
+		server.lockouts.succeed(username, host)
+	} else if reason != AuditLockedOut {
+		server.lockouts.fail(username, host)
+	}
+	return ok
+}
+
+// authenticate checks the password of a user. When pair is set, unknown users
+// other than the controller are left to the unknown user handler, which pairs
+// them even from a locked out address.
+func (server *Server) authenticate(username, password, host string, pair bool) (bool, string) {
+	if len(username) == 0 || len(password) == 0 {
+		return false, AuditEmptyCredentials
+	}
 
-	err := mqttServer.AddListener(tcp, &listeners.Config{
-		Auth: authHandler,
+	if storedPwd, ok := server.users.Get(username); ok {
+		if server.lockouts.isLocked(username, host) {
+			return false, AuditLockedOut
+		}
+		if !CheckPassword(storedPwd.(string), password) {
+			return false, AuditPasswordMismatch
+		}
+		return true, ""
+	}
+	// Without a password the controller only connects with Dial.
+	if pair && username != server.controller && server.unknownUser != nil && server.unknownUser(username, password) {
+		return true, AuditPaired
+	}
+	if server.lockouts.isLocked(username, host) {
+		return false, AuditLockedOut
+	}
+	return false, AuditUnknownUser
+}
+
+// serveConn authenticates a connection with its own Auth and tracks its
+// session until the connection ends.
+func (server *Server) serveConn(listener string, c net.Conn, method string, establish listeners.EstablishFunc) {
+	tracked := newConn(c)
+	a := createAuth(server, listener, c, tracked, method)
+	err := establish(listener, tracked, a)
+	if a.username != "" {
+		server.sessions.remove(a)
+		server.connectionEvent(a, false, disconnectReason(a, err))
+	}
+}
+
+// Start opens the listeners and serves clients in the background until
+// Close.
+func (server *Server) Start() error {
+	mqttServer := mqtt.New()
+	server.broker = mqttServer
+	if server.store != nil {
+		if err := mqttServer.AddStore(server.store); err != nil {
+			return fmt.Errorf("could not open the mqtt store: %w", err)
+		}
+		if store, ok := server.store.(*FileStore); ok {
+			store.setRetained(func() []persistence.Message {
+				return retainedMessages(mqttServer)
+			})
+		}
+	}
+	// The statistics are replaced when they are restored from the store.
+	sysInfo := func() *system.Info {
+		return mqttServer.System
+	}
+
+	for i, options := range server.listeners {
+		id := fmt.Sprintf("%s-%d", options.Type, i)
+		listener, err := newServerListener(server, sysInfo, id, options)
+		if err != nil {
+			return fmt.Errorf("could not configure %s listener on %s: %w", options.Type, options.Address, err)
+		}
+		if err := mqttServer.AddListener(listener, nil); err != nil {
+			mqttServer.Close()
+			return fmt.Errorf("could not start %s listener on %s: %w", options.Type, options.Address, err)
+		}
+		log.Printf("Started %s listener on: %s", options.Type, options.Address)
+	}
+	inProcess := newListener(ListenerInProcess, func() (net.Listener, error) {
+		return server.inProcess, nil
+	}, func(id string, conn net.Conn, establish listeners.EstablishFunc) {
+		server.serveConn(id, conn, authInProcess, establish)
 	})
-	if err != nil {
-		log.Fatal(err)
+	if err := mqttServer.AddListener(inProcess, nil); err != nil {
+		mqttServer.Close()
+		return fmt.Errorf("could not start the in-process listener: %w", err)
 	}
+
 	go mqttServer.Serve()
-	go func() {
-		<-sigs
-		mqttServer.Close()
-		log.Printf("mqtt server closed!")
-	}()
+	return nil
+}
+
+// retainedMessages returns the retained messages of a server as they are
+// stored.
+func retainedMessages(mqttServer *mqtt.Server) []persistence.Message {
+	messages := []persistence.Message{}
+	for _, pk := range mqttServer.Topics.Messages("#") {
+		messages = append(messages, persistence.Message{
+			ID:          "ret_" + pk.TopicName,
+			T:           persistence.KRetained,
+			FixedHeader: persistence.FixedHeader(pk.FixedHeader),
+			TopicName:   pk.TopicName,
+			Payload:     pk.Payload,
+		})
+	}
+	return messages
+}
+
+// Close disconnects every client, closes the listeners and saves the store.
+func (server *Server) Close() {
+	if server.broker == nil {
+		return
+	}
+	server.broker.Close()
+	log.Printf("mqtt server closed!")
 }
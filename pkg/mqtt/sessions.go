@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// sessions tracks the authenticated connections of every user, so that they
+// can be closed when the user is deleted.
+type sessions struct {
+	lock  sync.Mutex
+	users map[string]map[*Auth]bool
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		users: map[string]map[*Auth]bool{},
+	}
+}
+
+// add tracks the session of a connection. A session with the same client ID
+// is taken over, the server closes it right after. Clients without an ID get
+// a random one from the server and never take over another session.
+func (s *sessions) add(a *Auth) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if a.clientID != "" {
+		for _, auths := range s.users {
+			for other := range auths {
+				if other.clientID == a.clientID {
+					other.lock.Lock()
+					other.reason = ReasonTakenOver
+					other.lock.Unlock()
+				}
+			}
+		}
+	}
+	if s.users[a.username] == nil {
+		s.users[a.username] = map[*Auth]bool{}
+	}
+	s.users[a.username][a] = true
+}
+
+func (s *sessions) remove(a *Auth) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.users[a.username], a)
+	if len(s.users[a.username]) == 0 {
+		delete(s.users, a.username)
+	}
+}
+
+// disconnect closes every connection of the user and returns how many were
+// closed.
+func (s *sessions) disconnect(username string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for a := range s.users[username] {
+		a.close(ReasonUserDeleted)
+		count++
+	}
+	return count
+}
@@ -0,0 +1,29 @@
+package mqtt
+
+import "testing"
+
+func TestSessionsTakeOver(t *testing.T) {
+	s := newSessions()
+	first := &Auth{username: "fan1", clientID: "fan1"}
+	anonymous := &Auth{username: "fan2"}
+	s.add(first)
+	s.add(anonymous)
+
+	s.add(&Auth{username: "fan2"})
+	if first.reason != "" || anonymous.reason != "" {
+		t.Errorf("a client without an ID took over a session: %q, %q", first.reason, anonymous.reason)
+	}
+
+	s.add(&Auth{username: "fan1", clientID: "fan1"})
+	if first.reason != ReasonTakenOver {
+		t.Errorf("reason = %q, want %q", first.reason, ReasonTakenOver)
+	}
+	if anonymous.reason != "" {
+		t.Errorf("another session was marked as taken over: %q", anonymous.reason)
+	}
+
+	s.remove(first)
+	if got := len(s.users["fan1"]); got != 1 {
+		t.Errorf("fan1 has %d sessions after removing one, want 1", got)
+	}
+}
@@ -0,0 +1,243 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/persistence"
+)
+
+// FileStore is a persistence.Store that keeps everything in memory and saves
+// it to a JSON file shortly after every change and when it is closed.
+type FileStore struct {
+	path     string
+	interval time.Duration
+
+	lock  sync.Mutex
+	data  fileStoreData
+	dirty bool
+	// retained returns the retained messages of the server. The server
+	// deletes a retained message from the store when it is replaced rather
+	// than writing the new one, so they are taken from it on every save.
+	retained func() []persistence.Message
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type fileStoreData struct {
+	ServerInfo    persistence.ServerInfo              `json:"server_info"`
+	Subscriptions map[string]persistence.Subscription `json:"subscriptions"`
+	Clients       map[string]persistence.Client       `json:"clients"`
+	Inflight      map[string]persistence.Message      `json:"inflight"`
+	Retained      map[string]persistence.Message      `json:"retained"`
+}
+
+// NewFileStore returns a store saving to the given file at most once per
+// interval.
+func NewFileStore(path string, interval time.Duration) *FileStore {
+	return &FileStore{
+		path:     path,
+		interval: interval,
+		data: fileStoreData{
+			Subscriptions: map[string]persistence.Subscription{},
+			Clients:       map[string]persistence.Client{},
+			Inflight:      map[string]persistence.Message{},
+			Retained:      map[string]persistence.Message{},
+		},
+		done: make(chan struct{}),
+	}
+}
+
+// Open reads the file, which does not have to exist yet, and starts saving
+// changes.
+func (s *FileStore) Open() error {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		s.lock.Lock()
+		err = json.Unmarshal(content, &s.data)
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.save()
+			}
+		}
+	}()
+	return nil
+}
+
+// Close saves any pending change.
+func (s *FileStore) Close() {
+	close(s.done)
+	s.wg.Wait()
+	s.save()
+}
+
+func (s *FileStore) save() {
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return
+	}
+	if s.retained != nil {
+		s.data.Retained = map[string]persistence.Message{}
+		for _, message := range s.retained() {
+			s.data.Retained[message.ID] = message
+		}
+	}
+	content, err := json.Marshal(s.data)
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		log.Printf("Could not encode the mqtt store: %s", err)
+		return
+	}
+
+	if err := writeFileAtomic(s.path, content); err != nil {
+		log.Printf("Could not save the mqtt store to %s: %s", s.path, err)
+		s.lock.Lock()
+		s.dirty = true
+		s.lock.Unlock()
+	}
+}
+
+// setRetained sets the function the retained messages are saved from.
+func (s *FileStore) setRetained(retained func() []persistence.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retained = retained
+}
+
+func (s *FileStore) update(fn func(data *fileStoreData)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fn(&s.data)
+	s.dirty = true
+	return nil
+}
+
+func (s *FileStore) WriteSubscription(v persistence.Subscription) error {
+	return s.update(func(data *fileStoreData) { data.Subscriptions[v.ID] = v })
+}
+
+func (s *FileStore) WriteClient(v persistence.Client) error {
+	return s.update(func(data *fileStoreData) { data.Clients[v.ID] = v })
+}
+
+func (s *FileStore) WriteInflight(v persistence.Message) error {
+	return s.update(func(data *fileStoreData) { data.Inflight[v.ID] = v })
+}
+
+func (s *FileStore) WriteServerInfo(v persistence.ServerInfo) error {
+	return s.update(func(data *fileStoreData) { data.ServerInfo = v })
+}
+
+func (s *FileStore) WriteRetained(v persistence.Message) error {
+	return s.update(func(data *fileStoreData) { data.Retained[v.ID] = v })
+}
+
+func (s *FileStore) DeleteSubscription(id string) error {
+	return s.update(func(data *fileStoreData) { delete(data.Subscriptions, id) })
+}
+
+func (s *FileStore) DeleteClient(id string) error {
+	return s.update(func(data *fileStoreData) { delete(data.Clients, id) })
+}
+
+func (s *FileStore) DeleteInflight(id string) error {
+	return s.update(func(data *fileStoreData) { delete(data.Inflight, id) })
+}
+
+func (s *FileStore) DeleteRetained(id string) error {
+	return s.update(func(data *fileStoreData) { delete(data.Retained, id) })
+}
+
+func (s *FileStore) ReadSubscriptions() ([]persistence.Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := make([]persistence.Subscription, 0, len(s.data.Subscriptions))
+	for _, subscription := range s.data.Subscriptions {
+		v = append(v, subscription)
+	}
+	return v, nil
+}
+
+func (s *FileStore) ReadInflight() ([]persistence.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := make([]persistence.Message, 0, len(s.data.Inflight))
+	for _, message := range s.data.Inflight {
+		v = append(v, message)
+	}
+	return v, nil
+}
+
+func (s *FileStore) ReadRetained() ([]persistence.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := make([]persistence.Message, 0, len(s.data.Retained))
+	for _, message := range s.data.Retained {
+		v = append(v, message)
+	}
+	return v, nil
+}
+
+func (s *FileStore) ReadClients() ([]persistence.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := make([]persistence.Client, 0, len(s.data.Clients))
+	for _, client := range s.data.Clients {
+		v = append(v, client)
+	}
+	return v, nil
+}
+
+func (s *FileStore) ReadServerInfo() (persistence.ServerInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.data.ServerInfo, nil
+}
+
+// writeFileAtomic writes the file next to the old one and renames it, so that
+// a crash never leaves a partial file behind.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
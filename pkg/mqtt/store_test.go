@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mqtt "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/persistence"
+)
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startStoreServer serves a broker saving to the store the way Start does.
+func startStoreServer(t *testing.T, store *FileStore, address string) *mqtt.Server {
+	t.Helper()
+	server := mqtt.New()
+	if err := server.AddStore(store); err != nil {
+		t.Fatal(err)
+	}
+	store.setRetained(func() []persistence.Message {
+		return retainedMessages(server)
+	})
+	if err := server.AddListener(listeners.NewTCP("t1", address), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func publishRetained(t *testing.T, address, topic string, payloads ...string) {
+	t.Helper()
+	options := paho.NewClientOptions().AddBroker("tcp://" + address).SetClientID("store-test")
+	client := paho.NewClient(options)
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("could not connect: %v", token.Error())
+	}
+	defer client.Disconnect(100)
+	for _, payload := range payloads {
+		if token := client.Publish(topic, 1, true, payload); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("could not publish: %v", token.Error())
+		}
+	}
+}
+
+func TestFileStoreKeepsReplacedRetainedMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	address := freeAddress(t)
+
+	server := startStoreServer(t, NewFileStore(path, 10*time.Millisecond), address)
+	publishRetained(t, address, "state/fan1", "first", "second")
+	publishRetained(t, address, "state/fan2", "only")
+	server.Close()
+
+	reopened := NewFileStore(path, time.Hour)
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	messages, err := reopened.ReadRetained()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, message := range messages {
+		got[message.TopicName] = string(message.Payload)
+	}
+	want := map[string]string{"state/fan1": "second", "state/fan2": "only"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("retained messages after reopening = %v, want %v", got, want)
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	store := NewFileStore(path, time.Hour)
+	if err := store.Open(); err != nil {
+		t.Fatal(err)
+	}
+	store.WriteClient(persistence.Client{ID: "cl_fan1", ClientID: "fan1", T: persistence.KClient})
+	store.WriteSubscription(persistence.Subscription{ID: "sub_fan1:a/b", Client: "fan1", Filter: "a/b", QoS: 1, T: persistence.KSubscription})
+	store.WriteSubscription(persistence.Subscription{ID: "sub_fan1:c", Client: "fan1", Filter: "c", T: persistence.KSubscription})
+	store.DeleteSubscription("sub_fan1:c")
+	store.WriteInflight(persistence.Message{ID: "if_fan1_1", Client: "fan1", TopicName: "a/b", T: persistence.KInflight})
+	store.WriteServerInfo(persistence.ServerInfo{ID: "server_info"})
+	store.Close()
+
+	reopened := NewFileStore(path, time.Hour)
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	clients, _ := reopened.ReadClients()
+	if len(clients) != 1 || clients[0].ClientID != "fan1" {
+		t.Errorf("clients = %+v, want fan1", clients)
+	}
+	subscriptions, _ := reopened.ReadSubscriptions()
+	if len(subscriptions) != 1 || subscriptions[0].Filter != "a/b" || subscriptions[0].QoS != 1 {
+		t.Errorf("subscriptions = %+v, want a/b at QoS 1", subscriptions)
+	}
+	inflight, _ := reopened.ReadInflight()
+	if len(inflight) != 1 || inflight[0].TopicName != "a/b" {
+		t.Errorf("inflight = %+v, want a/b", inflight)
+	}
+	info, _ := reopened.ReadServerInfo()
+	if info.ID != "server_info" {
+		t.Errorf("server info = %+v", info)
+	}
+}
+
+func TestFileStoreOpenWithoutFile(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing.json"), time.Hour)
+	if err := store.Open(); err != nil {
+		t.Fatalf("opening a missing file: %s", err)
+	}
+	store.Close()
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// sysInfoListener serves the $SYS statistics of the server as JSON over HTTP.
+// Unless auth is disabled, requests need the basic auth of a server user.
+type sysInfoListener struct {
+	id      string
+	address string
+	config  *tls.Config
+	info    func() *system.Info
+	auth    func(username, password, remoteAddr string) bool
+	server  *http.Server
+	ln      net.Listener
+}
+
+func (l *sysInfoListener) SetConfig(config *listeners.Config) {}
+
+func (l *sysInfoListener) ID() string {
+	return l.id
+}
+
+func (l *sysInfoListener) Listen(s *system.Info) error {
+	ln, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+	if l.config != nil {
+		ln = tls.NewListener(ln, l.config)
+	}
+	l.ln = ln
+
+	l.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l.auth != nil {
+				username, password, ok := r.BasicAuth()
+				if !ok || !l.auth(username, password, r.RemoteAddr) {
+					w.Header().Set("WWW-Authenticate", `Basic realm="brightpod"`)
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(l.info())
+		}),
+	}
+	return nil
+}
+
+func (l *sysInfoListener) Serve(establish listeners.EstablishFunc) {
+	l.server.Serve(l.ln)
+}
+
+func (l *sysInfoListener) Close(closeClients listeners.CloseFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l.server.Shutdown(ctx)
+}
@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+func TestSysInfoAuthNeverPairs(t *testing.T) {
+	server := New(nil)
+	server.SetUsers(map[string]string{"fan1": "secret"})
+	paired := []string{}
+	server.SetUnknownUserHandler(func(username, password string) bool {
+		paired = append(paired, username)
+		return true
+	})
+
+	ln, err := newServerListener(server, func() *system.Info { return &system.Info{} }, "sysinfo",
+		ListenerOptions{Type: ListenerSysInfo, Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysInfo := ln.(*sysInfoListener)
+	if err := sysInfo.Listen(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer sysInfo.ln.Close()
+
+	get := func(username, password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		sysInfo.server.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("fan1", "secret"); code != http.StatusOK {
+		t.Errorf("existing user got %d, want %d", code, http.StatusOK)
+	}
+	if code := get("fan2", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("unknown user got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if len(paired) != 0 {
+		t.Errorf("sysinfo auth paired %v", paired)
+	}
+
+	// mqtt clients still reach the handler.
+	if !server.login("tcp", "127.0.0.1:50000", "fan2", "secret", true) || len(paired) != 1 {
+		t.Errorf("an mqtt client was not paired, paired %v", paired)
+	}
+}
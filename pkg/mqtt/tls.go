@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions configures TLS on a listener of the server.
+type TLSOptions struct {
+	CertFile string `mapstructure:"cert" yaml:"cert"`
+	KeyFile  string `mapstructure:"key" yaml:"key"`
+	// CAFile holds the certificates client certificates are verified with.
+	CAFile string `mapstructure:"ca" yaml:"ca,omitempty"`
+	// MinVersion is the lowest TLS version accepted, e.g. 1.2.
+	MinVersion string `mapstructure:"min-version" yaml:"min-version,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Validate checks the options without reading any file.
+func (options TLSOptions) Validate() error {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return fmt.Errorf("a certificate and a key are required")
+	}
+	if _, ok := tlsVersions[options.MinVersion]; !ok && options.MinVersion != "" {
+		return fmt.Errorf("unknown TLS version %s, expected one of 1.0, 1.1, 1.2 or 1.3", options.MinVersion)
+	}
+	return nil
+}
+
+// Config loads the certificates and returns the TLS configuration of the
+// listener. With clientCerts, clients must present a certificate signed by
+// the CA.
+func (options TLSOptions) Config(clientCerts bool) (*tls.Config, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if options.MinVersion != "" {
+		config.MinVersion = tlsVersions[options.MinVersion]
+	}
+
+	if options.CAFile != "" {
+		pool, err := LoadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if clientCerts {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of a file.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
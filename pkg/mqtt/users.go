@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns the bcrypt hash of a password as stored in a users file.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether the password matches the stored credential,
+// which is either a bcrypt hash or a plaintext password given on the command
+// line. Plaintext passwords are compared in constant time.
+func CheckPassword(stored, password string) bool {
+	if isHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func isHash(credential string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(credential, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadUsersFile reads an htpasswd style file with one user:hash line per
+// user. Empty lines and lines starting with # are ignored. Only bcrypt
+// hashes are accepted, as created by HashPassword or htpasswd -B.
+func ReadUsersFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, err := ParseUser(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, lineNumber, err)
+		}
+		if !isHash(hash) {
+			return nil, fmt.Errorf("%s line %d: password of user %s is not a bcrypt hash", path, lineNumber, username)
+		}
+		if _, ok := users[username]; ok {
+			return nil, fmt.Errorf("%s line %d: user %s is declared more than once", path, lineNumber, username)
+		}
+		users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// WriteUsersFile replaces the users file with the given users, sorted by
+// username. The file is replaced atomically so that a server reloading it
+// never sees a partial file.
+func WriteUsersFile(path string, users map[string]string) error {
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var content strings.Builder
+	for _, username := range usernames {
+		fmt.Fprintf(&content, "%s:%s\n", username, users[username])
+	}
+
+	return writeFileAtomic(path, []byte(content.String()))
+}
@@ -0,0 +1,116 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"hash", hash, "secret", true},
+		{"wrong password for a hash", hash, "Secret", false},
+		{"hash given as the password", hash, hash, false},
+		{"plaintext", "secret", "secret", true},
+		{"wrong plaintext", "secret", "secret2", false},
+		{"empty password", "secret", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := CheckPassword(tt.stored, tt.password); got != tt.want {
+			t.Errorf("%s: CheckPassword() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUsersFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteUsersFile(path, map[string]string{"fan2": hash, "fan1": hash}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "fan1:" + hash + "\nfan2:" + hash + "\n"; string(content) != want {
+		t.Errorf("users file is %q, want it sorted by username", content)
+	}
+
+	users, err := ReadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !CheckPassword(users["fan1"], "secret") || !CheckPassword(users["fan2"], "secret") {
+		t.Errorf("read back %v", users)
+	}
+}
+
+func TestReadUsersFile(t *testing.T) {
+	hash := "$2y$05$Y5XGdk8Nz3mNmiVQ4uE9teSyqN3qYwLgbf9ghyFOmQxEfSnkWnVtK"
+
+	tests := []struct {
+		name    string
+		content string
+		users   []string
+		wantErr string
+	}{
+		{name: "empty", content: ""},
+		{
+			name:    "comments and blank lines",
+			content: "# blowers\n\nfan1:" + hash + "\n  fan2:" + hash + "  \n",
+			users:   []string{"fan1", "fan2"},
+		},
+		{name: "plaintext password", content: "fan1:secret\n", wantErr: "line 1: password of user fan1 is not a bcrypt hash"},
+		{name: "missing password", content: "# blowers\nfan1\n", wantErr: "line 2"},
+		{name: "empty username", content: ":" + hash + "\n", wantErr: "line 1"},
+		{name: "duplicate user", content: "fan1:" + hash + "\nfan1:" + hash + "\n", wantErr: "line 2: user fan1 is declared more than once"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			users, err := ReadUsersFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(users) != len(tt.users) {
+				t.Fatalf("read %d users, want %d", len(users), len(tt.users))
+			}
+			for _, username := range tt.users {
+				if users[username] != hash {
+					t.Errorf("user %s has %q, want the hash", username, users[username])
+				}
+			}
+		})
+	}
+
+	if _, err := ReadUsersFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"mqtt"},
+	// Dashboards are served from other origins, clients still have to
+	// authenticate over mqtt.
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsListener accepts mqtt over websocket connections as a net.Listener.
+type wsListener struct {
+	ln     net.Listener
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func listenWebsocket(address string, config *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+
+	l := &wsListener{
+		ln:    ln,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	l.server = &http.Server{Handler: http.HandlerFunc(l.handler)}
+	go l.server.Serve(ln)
+	return l, nil
+}
+
+func (l *wsListener) handler(w http.ResponseWriter, r *http.Request) {
+	c, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	conn := &wsConn{Conn: c.UnderlyingConn(), ws: c, state: r.TLS}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("websocket listener closed")
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.server.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn carries mqtt packets in binary websocket messages.
+type wsConn struct {
+	net.Conn
+	ws     *websocket.Conn
+	reader io.Reader
+	state  *tls.ConnectionState
+}
+
+// Read reads from the current message, moving on to the next one once it is
+// consumed, as packets are not aligned with messages.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("websocket message is not binary")
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ConnectionState returns the TLS state of the websocket request, so that
+// client certificates work the same as on a TLS listener.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
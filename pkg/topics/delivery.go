@@ -0,0 +1,58 @@
+package topics
+
+import "fmt"
+
+// Delivery sets how messages of a topic are sent. Retain only applies to the
+// topics brightpod publishes to.
+type Delivery struct {
+	QoS    byte `mapstructure:"qos" yaml:"qos"`
+	Retain bool `mapstructure:"retain" yaml:"retain"`
+}
+
+// DeliveryOptions sets the delivery of each class of topic. KeepAlive and
+// Control set the QoS brightpod subscribes with, the others how it
+// publishes.
+type DeliveryOptions struct {
+	KeepAlive Delivery `mapstructure:"keepalive" yaml:"keepalive"`
+	Control   Delivery `mapstructure:"control" yaml:"control"`
+	Status    Delivery `mapstructure:"status" yaml:"status"`
+	State     Delivery `mapstructure:"state" yaml:"state"`
+	Discovery Delivery `mapstructure:"discovery" yaml:"discovery"`
+}
+
+// DefaultDeliveryOptions returns the delivery used when nothing is
+// configured. Status updates are acknowledged so that a blower does not miss
+// a command, state and discovery are retained for late subscribers.
+func DefaultDeliveryOptions() DeliveryOptions {
+	return DeliveryOptions{
+		Status:    Delivery{QoS: 1},
+		State:     Delivery{Retain: true},
+		Discovery: Delivery{Retain: true},
+	}
+}
+
+// Validate checks the QoS of every class and that subscriptions are not
+// retained.
+func (options DeliveryOptions) Validate() error {
+	classes := []struct {
+		name       string
+		delivery   Delivery
+		subscribed bool
+	}{
+		{"keepalive", options.KeepAlive, true},
+		{"control", options.Control, true},
+		{"status", options.Status, false},
+		{"state", options.State, false},
+		{"discovery", options.Discovery, false},
+	}
+
+	for _, class := range classes {
+		if class.delivery.QoS > 2 {
+			return fmt.Errorf("%s qos must be 0, 1 or 2, recieved: %d", class.name, class.delivery.QoS)
+		}
+		if class.subscribed && class.delivery.Retain {
+			return fmt.Errorf("%s topics are subscribed to, retain does not apply", class.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package topics
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	placeholderID      = "{id}"
+	placeholderCommand = "{command}"
+	placeholderEvent   = "{event}"
+	wildcard           = "+"
+)
+
+// Layout resolves every topic brightpod subscribes and publishes to. Each
+// template is a topic with placeholders such as {id} taking up whole levels.
+// Every topic is prefixed with the root when one is set, except the keepalive
+// and status topics, which the blower firmware uses as they are.
+type Layout struct {
+	Root         string `mapstructure:"root" yaml:"root"`
+	KeepAlive    string `mapstructure:"keepalive" yaml:"keepalive"`
+	Status       string `mapstructure:"status" yaml:"status"`
+	Control      string `mapstructure:"control" yaml:"control"`
+	State        string `mapstructure:"state" yaml:"state"`
+	Availability string `mapstructure:"availability" yaml:"availability"`
+	Event        string `mapstructure:"event" yaml:"event"`
+	// Service is where brightpod reports its own availability, it is
+	// marked offline by the broker when brightpod goes away unexpectedly.
+	Service string `mapstructure:"service" yaml:"service"`
+}
+
+// DefaultLayout returns the topics used by the blower firmware and by
+// brightpod when nothing is configured.
+func DefaultLayout() Layout {
+	return Layout{
+		KeepAlive:    "{id}/keep_alive",
+		Status:       "{id}/status",
+		Control:      "control/{id}/{command}",
+		State:        "state/{id}",
+		Availability: "state/{id}/availability",
+		Event:        "events/{id}/{event}",
+		Service:      "brightpod/availability",
+	}
+}
+
+// Validate checks that every template has the placeholders it needs.
+func (layout Layout) Validate() error {
+	templates := []struct {
+		name         string
+		template     string
+		placeholders []string
+	}{
+		{"keepalive", layout.KeepAlive, []string{placeholderID}},
+		{"status", layout.Status, []string{placeholderID}},
+		{"control", layout.Control, []string{placeholderID, placeholderCommand}},
+		{"state", layout.State, []string{placeholderID}},
+		{"availability", layout.Availability, []string{placeholderID}},
+		{"event", layout.Event, []string{placeholderID, placeholderEvent}},
+		{"service", layout.Service, nil},
+	}
+
+	if strings.ContainsAny(layout.Root, "+#") {
+		return fmt.Errorf("topic root cannot contain wildcards: %s", layout.Root)
+	}
+	for _, t := range templates {
+		if t.template == "" {
+			return fmt.Errorf("%s topic cannot be empty", t.name)
+		}
+		if strings.ContainsAny(t.template, "+#") {
+			return fmt.Errorf("%s topic cannot contain wildcards: %s", t.name, t.template)
+		}
+		levels := strings.Split(t.template, "/")
+		for _, placeholder := range t.placeholders {
+			if !contains(levels, placeholder) {
+				return fmt.Errorf("%s topic must contain %s as a whole level: %s", t.name, placeholder, t.template)
+			}
+		}
+	}
+	if layout.State == layout.Availability {
+		return fmt.Errorf("state and availability topics must differ: %s", layout.State)
+	}
+	return nil
+}
+
+// KeepAliveTopic returns the topic a blower sends its keepalives to.
+func (layout Layout) KeepAliveTopic(id string) string {
+	return layout.resolve(layout.KeepAlive, map[string]string{placeholderID: id})
+}
+
+// StatusTopic returns the topic a blower reads its settings from.
+func (layout Layout) StatusTopic(id string) string {
+	return layout.resolve(layout.Status, map[string]string{placeholderID: id})
+}
+
+// ControlTopic returns the topic a command for a blower is sent to.
+func (layout Layout) ControlTopic(id, command string) string {
+	return layout.resolve(layout.withRoot(layout.Control), map[string]string{placeholderID: id, placeholderCommand: command})
+}
+
+// StateTopic returns the topic the state of a blower is published to.
+func (layout Layout) StateTopic(id string) string {
+	return layout.resolve(layout.withRoot(layout.State), map[string]string{placeholderID: id})
+}
+
+// AvailabilityTopic returns the topic the availability of a blower is published to.
+func (layout Layout) AvailabilityTopic(id string) string {
+	return layout.resolve(layout.withRoot(layout.Availability), map[string]string{placeholderID: id})
+}
+
+// EventTopic returns the topic an event of a blower is published to.
+func (layout Layout) EventTopic(id, event string) string {
+	return layout.resolve(layout.withRoot(layout.Event), map[string]string{placeholderID: id, placeholderEvent: event})
+}
+
+// ServiceTopic returns the topic the availability of brightpod itself is
+// published to.
+func (layout Layout) ServiceTopic() string {
+	return layout.withRoot(layout.Service)
+}
+
+// KeepAliveFilter returns the subscription filter matching the keepalives of
+// every blower.
+func (layout Layout) KeepAliveFilter() string {
+	return layout.resolve(layout.KeepAlive, map[string]string{placeholderID: wildcard})
+}
+
+// ControlFilter returns the subscription filter matching every command of
+// every blower.
+func (layout Layout) ControlFilter() string {
+	return layout.resolve(layout.withRoot(layout.Control), map[string]string{placeholderID: wildcard, placeholderCommand: wildcard})
+}
+
+// MatchKeepAlive returns the blower ID of a keepalive topic.
+func (layout Layout) MatchKeepAlive(topic string) (string, bool) {
+	values, ok := layout.match(layout.KeepAlive, topic)
+	return values[placeholderID], ok
+}
+
+// MatchControl returns the blower ID and the command of a control topic.
+func (layout Layout) MatchControl(topic string) (string, string, bool) {
+	values, ok := layout.match(layout.withRoot(layout.Control), topic)
+	return values[placeholderID], values[placeholderCommand], ok
+}
+
+func (layout Layout) resolve(template string, values map[string]string) string {
+	levels := strings.Split(template, "/")
+	for i, level := range levels {
+		if value, ok := values[level]; ok {
+			levels[i] = value
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+func (layout Layout) match(template, topic string) (map[string]string, bool) {
+	values := map[string]string{}
+	templateLevels := strings.Split(template, "/")
+	topicLevels := strings.Split(topic, "/")
+	if len(templateLevels) != len(topicLevels) {
+		return values, false
+	}
+
+	for i, level := range templateLevels {
+		if strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}") {
+			values[level] = topicLevels[i]
+		} else if level != topicLevels[i] {
+			return map[string]string{}, false
+		}
+	}
+	return values, true
+}
+
+func (layout Layout) withRoot(template string) string {
+	root := strings.Trim(layout.Root, "/")
+	if root == "" {
+		return template
+	}
+	return root + "/" + template
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
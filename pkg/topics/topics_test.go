@@ -0,0 +1,123 @@
+package topics
+
+import "testing"
+
+func TestLayoutResolve(t *testing.T) {
+	custom := Layout{
+		Root:         "/home/brightpod/",
+		KeepAlive:    "blowers/{id}/keepalive",
+		Status:       "blowers/{id}/set",
+		Control:      "{id}/cmd/{command}",
+		State:        "blowers/{id}",
+		Availability: "blowers/{id}/online",
+		Event:        "blowers/{id}/{event}/event",
+		Service:      "service",
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"keepalive", DefaultLayout().KeepAliveTopic("fan1"), "fan1/keep_alive"},
+		{"status", DefaultLayout().StatusTopic("fan1"), "fan1/status"},
+		{"control", DefaultLayout().ControlTopic("fan1", "mode"), "control/fan1/mode"},
+		{"state", DefaultLayout().StateTopic("fan1"), "state/fan1"},
+		{"availability", DefaultLayout().AvailabilityTopic("fan1"), "state/fan1/availability"},
+		{"event", DefaultLayout().EventTopic("fan1", "reboot"), "events/fan1/reboot"},
+		{"service", DefaultLayout().ServiceTopic(), "brightpod/availability"},
+		{"keepalive filter", DefaultLayout().KeepAliveFilter(), "+/keep_alive"},
+		{"control filter", DefaultLayout().ControlFilter(), "control/+/+"},
+		{"keepalive without root", custom.KeepAliveTopic("fan1"), "blowers/fan1/keepalive"},
+		{"status without root", custom.StatusTopic("fan1"), "blowers/fan1/set"},
+		{"rooted control", custom.ControlTopic("fan1", "power"), "home/brightpod/fan1/cmd/power"},
+		{"rooted event", custom.EventTopic("fan1", "reboot"), "home/brightpod/blowers/fan1/reboot/event"},
+		{"rooted service", custom.ServiceTopic(), "home/brightpod/service"},
+		{"rooted state", custom.StateTopic("fan1"), "home/brightpod/blowers/fan1"},
+		{"rooted availability", custom.AvailabilityTopic("fan1"), "home/brightpod/blowers/fan1/online"},
+		{"keepalive filter without root", custom.KeepAliveFilter(), "blowers/+/keepalive"},
+		{"rooted control filter", custom.ControlFilter(), "home/brightpod/+/cmd/+"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s topic = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLayoutMatch(t *testing.T) {
+	rooted := DefaultLayout()
+	rooted.Root = "home"
+
+	keepAlives := []struct {
+		layout Layout
+		topic  string
+		id     string
+		ok     bool
+	}{
+		{DefaultLayout(), "fan1/keep_alive", "fan1", true},
+		{DefaultLayout(), "fan1/status", "", false},
+		{DefaultLayout(), "home/fan1/keep_alive", "", false},
+		{DefaultLayout(), "keep_alive", "", false},
+		{rooted, "fan1/keep_alive", "fan1", true},
+		{rooted, "home/fan1/keep_alive", "", false},
+	}
+	for _, tt := range keepAlives {
+		id, ok := tt.layout.MatchKeepAlive(tt.topic)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("MatchKeepAlive(%s) = %q, %v, want %q, %v", tt.topic, id, ok, tt.id, tt.ok)
+		}
+	}
+
+	controls := []struct {
+		layout  Layout
+		topic   string
+		id      string
+		command string
+		ok      bool
+	}{
+		{DefaultLayout(), "control/fan1/mode", "fan1", "mode", true},
+		{DefaultLayout(), "control/fan1", "", "", false},
+		{DefaultLayout(), "control/fan1/mode/extra", "", "", false},
+		{DefaultLayout(), "state/fan1/mode", "", "", false},
+		{rooted, "home/control/fan1/set", "fan1", "set", true},
+		{rooted, "control/fan1/set", "", "", false},
+	}
+	for _, tt := range controls {
+		id, command, ok := tt.layout.MatchControl(tt.topic)
+		if id != tt.id || command != tt.command || ok != tt.ok {
+			t.Errorf("MatchControl(%s) = %q, %q, %v, want %q, %q, %v", tt.topic, id, command, ok, tt.id, tt.command, tt.ok)
+		}
+	}
+}
+
+func TestLayoutValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(layout *Layout)
+		wantErr bool
+	}{
+		{name: "default layout", modify: func(layout *Layout) {}},
+		{name: "root", modify: func(layout *Layout) { layout.Root = "home/brightpod" }},
+		{name: "wildcard in root", modify: func(layout *Layout) { layout.Root = "home/+" }, wantErr: true},
+		{name: "empty template", modify: func(layout *Layout) { layout.Status = "" }, wantErr: true},
+		{name: "wildcard in template", modify: func(layout *Layout) { layout.State = "state/#" }, wantErr: true},
+		{name: "missing id", modify: func(layout *Layout) { layout.KeepAlive = "keep_alive" }, wantErr: true},
+		{name: "id inside a level", modify: func(layout *Layout) { layout.KeepAlive = "fan-{id}/keep_alive" }, wantErr: true},
+		{name: "missing command", modify: func(layout *Layout) { layout.Control = "control/{id}" }, wantErr: true},
+		{name: "missing event", modify: func(layout *Layout) { layout.Event = "events/{id}" }, wantErr: true},
+		{name: "state and availability alike", modify: func(layout *Layout) { layout.Availability = layout.State }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := DefaultLayout()
+			tt.modify(&layout)
+			err := layout.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}